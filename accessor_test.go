@@ -0,0 +1,100 @@
+// Copyright 2021-2022 Nao Yonashiro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blurhash
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+)
+
+// accessorImage returns detailImage(w, h) converted to the image type that
+// selects the named branch of fastAccessor, so that every branch encodes the
+// same content. The gray and alpha types keep only the luma.
+func accessorImage(kind string, w, h int) image.Image {
+	src := detailImage(w, h)
+	var dst draw.Image
+	switch kind {
+	case "YCbCr":
+		img := image.NewYCbCr(src.Rect, image.YCbCrSubsampleRatio420)
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				c := src.NRGBAAt(x, y)
+				yy, cb, cr := color.RGBToYCbCr(c.R, c.G, c.B)
+				img.Y[img.YOffset(x, y)] = yy
+				ci := img.COffset(x, y)
+				img.Cb[ci], img.Cr[ci] = cb, cr
+			}
+		}
+		return img
+	case "NRGBA":
+		return src
+	case "RGBA":
+		dst = image.NewRGBA(src.Rect)
+	case "Gray":
+		dst = image.NewGray(src.Rect)
+	case "Gray16":
+		dst = image.NewGray16(src.Rect)
+	case "Alpha", "Alpha16":
+		gray := image.NewGray(src.Rect)
+		draw.Draw(gray, gray.Rect, src, image.Point{}, draw.Src)
+		if kind == "Alpha" {
+			return &image.Alpha{Pix: gray.Pix, Stride: gray.Stride, Rect: gray.Rect}
+		}
+		img := image.NewAlpha16(src.Rect)
+		for i, v := range gray.Pix {
+			img.Pix[2*i], img.Pix[2*i+1] = v, v
+		}
+		return img
+	case "generic":
+		return genericImage{src}
+	default:
+		panic("unknown accessor " + kind)
+	}
+	draw.Draw(dst, dst.Bounds(), src, image.Point{}, draw.Src)
+	return dst
+}
+
+func TestAccessorImage(t *testing.T) {
+	for _, kind := range []string{"YCbCr", "NRGBA", "RGBA", "Gray", "Gray16", "Alpha", "Alpha16", "generic"} {
+		img := accessorImage(kind, 64, 48)
+		_, fast := fastAccessor(img)
+		if want := kind != "RGBA" && kind != "generic"; fast != want {
+			t.Errorf("%s: fastAccessor reports fast = %v, want %v", kind, fast, want)
+		}
+		if got, want := img.Bounds(), image.Rect(0, 0, 64, 48); got != want {
+			t.Errorf("%s: bounds = %v, want %v", kind, got, want)
+		}
+	}
+}
+
+func benchmarkAccessor(b *testing.B, kind string) {
+	img := accessorImage(kind, 256, 192)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		Encode(img, 4, 3)
+	}
+}
+
+func BenchmarkAccessorYCbCr(b *testing.B)   { benchmarkAccessor(b, "YCbCr") }
+func BenchmarkAccessorNRGBA(b *testing.B)   { benchmarkAccessor(b, "NRGBA") }
+func BenchmarkAccessorRGBA(b *testing.B)    { benchmarkAccessor(b, "RGBA") }
+func BenchmarkAccessorGray(b *testing.B)    { benchmarkAccessor(b, "Gray") }
+func BenchmarkAccessorGray16(b *testing.B)  { benchmarkAccessor(b, "Gray16") }
+func BenchmarkAccessorAlpha(b *testing.B)   { benchmarkAccessor(b, "Alpha") }
+func BenchmarkAccessorAlpha16(b *testing.B) { benchmarkAccessor(b, "Alpha16") }
+func BenchmarkAccessorGeneric(b *testing.B) { benchmarkAccessor(b, "generic") }
@@ -15,6 +15,8 @@
 package blurhash
 
 import (
+	"errors"
+	"fmt"
 	"image"
 	"image/color"
 	"math"
@@ -22,78 +24,390 @@ import (
 
 func init() {
 	buildLinearTable()
+	buildBase83Table()
 }
 
-func Append(dst []byte, img image.Image, w, h int) []byte {
-	factors := make([]factor, 81)[:w*h]
+// ErrInvalidComponents is returned when the number of components is out of range.
+var ErrInvalidComponents = errors.New("blurhash: components must be in range 1..9")
+
+// Append appends the blurhash of img with w horizontal and h vertical components to dst.
+// As in the reference implementation, w is the number of components along the
+// x axis (componentX) and the components are stored row by row, x varying fastest.
+// The format cannot represent more than 9 components per axis, so Append panics
+// if w or h is not in range 1..9, or if img is rejected by WithStrict.
+// Use EncodeChecked to get an error instead.
+//
+// An *image.Alpha or *image.Alpha16 is not encoded as transparent black but as an
+// opaque grayscale image whose luminance is the alpha of each pixel, which gives a
+// placeholder of the shape of a mask. WithStrict rejects them.
+//
+// Pixels are accumulated in a fixed row-major order on a single goroutine,
+// so the same input always produces the same hash regardless of GOMAXPROCS.
+func Append(dst []byte, img image.Image, w, h int, opts ...EncodeOption) []byte {
+	cfg := newEncodeConfig(opts)
+	if err := checkEncode(img, w, h, cfg); err != nil {
+		panic(err)
+	}
+	dst, _ = appendImage(dst, img, w, h, cfg)
+	return dst
+}
+
+// checkEncode reports why img cannot be encoded with w x h components.
+func checkEncode(img image.Image, w, h int, cfg encodeConfig) error {
+	if w, h = cfg.components(w, h); !validComponents(w, h) {
+		return ErrInvalidComponents
+	}
+	if cfg.strict {
+		m := img.ColorModel()
+		if u, ok := img.(*image.Uniform); ok {
+			// An image.Uniform is its own color model, so check the model of its color.
+			if m = colorModelOf(u.C); m == nil {
+				return fmt.Errorf("blurhash: unsupported color %T", u.C)
+			}
+		}
+		if err := checkColorModel(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkImageSize reports whether img has fewer pixels than components along
+// either axis, in which case the extra components carry no information.
+func checkImageSize(img image.Image, w, h int, cfg encodeConfig) error {
+	w, h = cfg.components(w, h)
+	if cfg.transpose {
+		// The components are laid out on the transposed image.
+		w, h = h, w
+	}
+	imgW, imgH := img.Bounds().Dx(), img.Bounds().Dy()
+	if imgW < w || imgH < h {
+		return fmt.Errorf("blurhash: %dx%d image is smaller than %dx%d components; use fewer components, for example with WithMaxComponents", imgW, imgH, w, h)
+	}
+	return nil
+}
+
+// checkColorModel reports whether m is a color model whose colors can be encoded
+// as RGB without reinterpretation.
+func checkColorModel(m color.Model) error {
+	if _, ok := m.(color.Palette); ok {
+		return nil
+	}
+	switch m {
+	case color.RGBAModel, color.RGBA64Model, color.NRGBAModel, color.NRGBA64Model,
+		color.GrayModel, color.Gray16Model, color.YCbCrModel, color.NYCbCrAModel, color.CMYKModel:
+		return nil
+	case color.AlphaModel, color.Alpha16Model:
+		return errors.New("blurhash: alpha-only images have no color")
+	}
+	return fmt.Errorf("blurhash: unsupported color model %T", m)
+}
+
+// colorModelOf returns the standard color model whose colors have the type of c,
+// or nil if there is none.
+func colorModelOf(c color.Color) color.Model {
+	switch c.(type) {
+	case color.RGBA:
+		return color.RGBAModel
+	case color.RGBA64:
+		return color.RGBA64Model
+	case color.NRGBA:
+		return color.NRGBAModel
+	case color.NRGBA64:
+		return color.NRGBA64Model
+	case color.Gray:
+		return color.GrayModel
+	case color.Gray16:
+		return color.Gray16Model
+	case color.YCbCr:
+		return color.YCbCrModel
+	case color.NYCbCrA:
+		return color.NYCbCrAModel
+	case color.CMYK:
+		return color.CMYKModel
+	case color.Alpha:
+		return color.AlphaModel
+	case color.Alpha16:
+		return color.Alpha16Model
+	}
+	return nil
+}
+
+// appendImage implements Append and also returns the normalised DC factor.
+func appendImage(dst []byte, img image.Image, w, h int, cfg encodeConfig) ([]byte, factor) {
+	w, h = cfg.components(w, h)
+	if u, ok := img.(*image.Uniform); ok {
+		// An image.Uniform is infinite, so only its DC term is non-zero.
+		factors := make([]factor, 81)[:w*h]
+		pR, pG, pB, pA := u.C.RGBA()
+		pR, pG, pB = cfg.composite(pR, pG, pB, pA)
+		factors[0] = factor{
+			r: sRGB((pR >> 8) & 0xff).linear(),
+			g: sRGB((pG >> 8) & 0xff).linear(),
+			b: sRGB((pB >> 8) & 0xff).linear(),
+		}
+		if cfg.toneMap != nil {
+			factors[0] = cfg.applyToneMap(factors[0])
+		}
+		return appendFactors(dst, factors, w, h, cfg), factors[0]
+	}
 
 	bounds := img.Bounds()
-	imgW := bounds.Dx()
-	imgH := bounds.Dy()
+	cfg.focalRect = cfg.focalRect.Sub(bounds.Min)
+	switch img.(type) {
+	case *image.Gray, *image.Gray16, *image.Alpha, *image.Alpha16:
+		cfg.gray = cfg.toneMap == nil
+	}
+	var fastAt func(x, y int) (r, b, g, a uint32)
+	var fast bool
+	if cfg.scratch != nil {
+		fastAt, fast = cfg.scratch.accessor(img)
+	} else {
+		fastAt, fast = fastAccessor(img)
+	}
+	if !fast && cfg.slowPathHook != nil {
+		cfg.slowPathHook(fmt.Sprintf("%T", img))
+	}
+	switch img.(type) {
+	case *image.Alpha, *image.Alpha16:
+		// Masks are encoded as opaque gray, using alpha as luminance.
+		alphaAt := fastAt
+		fastAt = func(x, y int) (r, b, g, a uint32) {
+			v, _, _, _ := alphaAt(x, y)
+			return v, v, v, 0xffff
+		}
+	}
+	at := func(x, y int) factor {
+		pR, pG, pB, pA := fastAt(bounds.Min.X+x, bounds.Min.Y+y)
+		pR, pG, pB = cfg.composite(pR, pG, pB, pA)
+		return factor{
+			r: sRGB((pR >> 8) & 0xff).linear(),
+			g: sRGB((pG >> 8) & 0xff).linear(),
+			b: sRGB((pB >> 8) & 0xff).linear(),
+		}
+	}
+	return appendLinear(dst, at, bounds.Dx(), bounds.Dy(), w, h, cfg)
+}
+
+// AppendBytes is like Append but takes the pixels of an imgW x imgH image in the
+// layout of image.RGBA.Pix, with alpha-premultiplied R, G, B, A bytes and rows
+// stride bytes apart. It panics under the same conditions as Append.
+func AppendBytes(dst []byte, pix []byte, stride, imgW, imgH, w, h int, opts ...EncodeOption) []byte {
+	return appendBytes(dst, pix, 0, 2, stride, imgW, imgH, w, h, opts)
+}
+
+// AppendBytesBGRA is like AppendBytes but takes pixels in B, G, R, A order,
+// as delivered by many native frameworks.
+func AppendBytesBGRA(dst []byte, pix []byte, stride, imgW, imgH, w, h int, opts ...EncodeOption) []byte {
+	return appendBytes(dst, pix, 2, 0, stride, imgW, imgH, w, h, opts)
+}
 
-	piW := math.Pi / float64(imgW)
-	piH := math.Pi / float64(imgH)
+// appendBytes implements AppendBytes and AppendBytesBGRA. rOff and bOff are the
+// offsets of the red and blue bytes within a pixel.
+func appendBytes(dst []byte, pix []byte, rOff, bOff, stride, imgW, imgH, w, h int, opts []EncodeOption) []byte {
+	cfg := newEncodeConfig(opts)
+	if !validComponents(cfg.components(w, h)) {
+		panic(ErrInvalidComponents)
+	}
+	at := func(x, y int) factor {
+		p := pix[y*stride+x*4:][:4:4]
+		pR, pG, pB := cfg.composite(uint32(p[rOff])*0x101, uint32(p[1])*0x101, uint32(p[bOff])*0x101, uint32(p[3])*0x101)
+		return factor{
+			r: sRGB(pR >> 8).linear(),
+			g: sRGB(pG >> 8).linear(),
+			b: sRGB(pB >> 8).linear(),
+		}
+	}
+	dst, _ = appendLinear(dst, at, imgW, imgH, w, h, cfg)
+	return dst
+}
 
-	yCos := make([]float64, 9)[:h]
-	ySin := make([]float64, 9)[:h]
-	yRotCos := make([]float64, 9)[:h]
-	yRotSin := make([]float64, 9)[:h]
-	for i := 0; i < h; i++ {
-		yRotSin[i], yRotCos[i] = math.Sincos(piH * float64(i))
+// AppendLinearF32 is like Append but takes linear RGB pixels as float32 values.
+// The pixel at (x, y) is pix[y*stride+x*3:][:3] in R, G, B order.
+// Values are clamped to range 0..1. It panics under the same conditions as Append.
+func AppendLinearF32(dst []byte, pix []float32, stride, imgW, imgH, w, h int, opts ...EncodeOption) []byte {
+	cfg := newEncodeConfig(opts)
+	if !validComponents(cfg.components(w, h)) {
+		panic(ErrInvalidComponents)
 	}
+	at := func(x, y int) factor {
+		p := pix[y*stride+x*3:]
+		return factor{
+			r: clamp(0, 1, float64(p[0])),
+			g: clamp(0, 1, float64(p[1])),
+			b: clamp(0, 1, float64(p[2])),
+		}
+	}
+	dst, _ = appendLinear(dst, at, imgW, imgH, w, h, cfg)
+	return dst
+}
 
-	xCos := make([]float64, 9)[:w]
-	xSin := make([]float64, 9)[:w]
-	xRotCos := make([]float64, 9)[:w]
-	xRotSin := make([]float64, 9)[:w]
-	for j := 0; j < w; j++ {
-		xRotSin[j], xRotCos[j] = math.Sincos(piW * float64(j))
+// appendLinear encodes an imgW x imgH image whose linear pixels are returned by at.
+func appendLinear(dst []byte, at func(x, y int) factor, imgW, imgH, w, h int, cfg encodeConfig) ([]byte, factor) {
+	w, h = cfg.components(w, h)
+	if cfg.toneMap != nil {
+		pixel := at
+		at = func(x, y int) factor {
+			return cfg.applyToneMap(pixel(x, y))
+		}
 	}
+	if cfg.transpose {
+		pixel := at
+		at = func(x, y int) factor {
+			return pixel(y, x)
+		}
+		imgW, imgH = imgH, imgW
+		r := cfg.focalRect
+		cfg.focalRect = image.Rect(r.Min.Y, r.Min.X, r.Max.Y, r.Max.X)
+	}
+	factors := make([]factor, 81)[:w*h]
+	if imgW == 0 || imgH == 0 {
+		return appendFactors(dst, factors, w, h, cfg), factors[0]
+	}
+
+	focal := cfg.focalWeight > 0 && !cfg.focalRect.Empty()
+	stride := cfg.sampleStride
 
-	fastAt := fastAccessor(img)
+	cos := cfg.cosines
+	if cos == nil {
+		cos = &Cosines{x: cosTable(nil, imgW, w), y: cosTable(nil, imgH, h)}
+	}
+
+	// The channels are accumulated in separate arrays, which accumulate4x3 and the
+	// gray path build on. On its own the layout is no faster than an array of
+	// structs; BenchmarkEncodeLayout compares them.
+	var factorsR, factorsG, factorsB [81]float64
+	var aos [81]factor // used instead if accumulateAoS is set
+	var totalWeight float64
 	for y := 0; y < imgH; y++ {
-		for i := range yCos {
-			if y == 0 || i == 0 {
-				ySin[i], yCos[i] = 0, 1
+		yCos := cos.y[y*9 : y*9+h]
+		for x := 0; x < imgW && y%stride == 0; x += stride {
+			xCos := cos.x[x*9 : x*9+w]
+			c := at(x, y)
+			if focal && (image.Point{X: x, Y: y}).In(cfg.focalRect) {
+				c.Scale(cfg.focalWeight)
+				totalWeight += cfg.focalWeight
 			} else {
-				ySin[i], yCos[i] = rotate(ySin[i], yCos[i], yRotSin[i], yRotCos[i])
+				totalWeight++
 			}
-		}
-		for x := 0; x < imgW; x++ {
-			for j := range xCos {
-				if x == 0 || j == 0 {
-					xSin[j], xCos[j] = 0, 1
-				} else {
-					xSin[j], xCos[j] = rotate(xSin[j], xCos[j], xRotSin[j], xRotCos[j])
+			if cfg.gray {
+				for i := 0; i < h; i++ {
+					row := factorsR[i*w : i*w+w]
+					for j, xc := range xCos {
+						row[j] += yCos[i] * xc * c.r
+					}
 				}
+				continue
+			}
+			if w == 4 && h == 3 && useAccumulate4x3 {
+				accumulate4x3(&factorsR, &factorsG, &factorsB, xCos, yCos, c)
+				continue
+			}
+			if accumulateAoS {
+				for i := 0; i < h; i++ {
+					row := aos[i*w : i*w+w]
+					for j, xc := range xCos {
+						basis := yCos[i] * xc
+						f := &row[j]
+						f.r += basis * c.r
+						f.g += basis * c.g
+						f.b += basis * c.b
+					}
+				}
+				continue
 			}
-
-			pR, pG, pB, _ := fastAt(x, y)
-			r := sRGB((pR >> 8) & 0xff).linear()
-			g := sRGB((pG >> 8) & 0xff).linear()
-			b := sRGB((pB >> 8) & 0xff).linear()
-
 			for i := 0; i < h; i++ {
-				for j := 0; j < w; j++ {
-					basis := yCos[i] * xCos[j]
-					factors[i*w+j].r += basis * r
-					factors[i*w+j].g += basis * g
-					factors[i*w+j].b += basis * b
+				rowR := factorsR[i*w : i*w+w]
+				rowG := factorsG[i*w : i*w+w]
+				rowB := factorsB[i*w : i*w+w]
+				for j, xc := range xCos {
+					basis := yCos[i] * xc
+					rowR[j] += basis * c.r
+					rowG[j] += basis * c.g
+					rowB[j] += basis * c.b
 				}
 			}
 		}
+		if cfg.progress != nil {
+			cfg.progress(y+1, imgH)
+		}
 	}
 
-	dc := factors[0]
-	dc.Scale(1 / float64(imgH*imgW))
+	if cfg.gray {
+		factorsG, factorsB = factorsR, factorsR
+	}
+	for i := range factors {
+		factors[i] = factor{r: factorsR[i], g: factorsG[i], b: factorsB[i]}
+	}
+	if accumulateAoS && !cfg.gray && !(w == 4 && h == 3 && useAccumulate4x3) {
+		copy(factors, aos[:])
+	}
+	normalizeFactors(factors, totalWeight)
+	return appendFactors(dst, factors, w, h, cfg), factors[0]
+}
+
+func (cfg *encodeConfig) applyToneMap(c factor) factor {
+	c.r, c.g, c.b = cfg.toneMap(c.r, c.g, c.b)
+	return c
+}
+
+// These switches select the accumulation loops of appendLinear. They let the
+// benchmarks compare the encoder with and without each optimisation, and are
+// never changed outside tests.
+var (
+	// useAccumulate4x3 enables the unrolled loop for 4x3 components.
+	useAccumulate4x3 = true
+	// accumulateAoS accumulates the general case in an array of structs, the
+	// layout used before the channels were split into separate arrays.
+	accumulateAoS = false
+)
+
+// accumulate4x3 is the inner loop of appendLinear unrolled for 4x3 components,
+// the most common grid.
+func accumulate4x3(factorsR, factorsG, factorsB *[81]float64, xCos, yCos []float64, c factor) {
+	_, _ = xCos[3], yCos[2]
+	for i := 0; i < 3; i++ {
+		b0, b1, b2, b3 := yCos[i]*xCos[0], yCos[i]*xCos[1], yCos[i]*xCos[2], yCos[i]*xCos[3]
+		k := i * 4
+		factorsR[k] += b0 * c.r
+		factorsR[k+1] += b1 * c.r
+		factorsR[k+2] += b2 * c.r
+		factorsR[k+3] += b3 * c.r
+		factorsG[k] += b0 * c.g
+		factorsG[k+1] += b1 * c.g
+		factorsG[k+2] += b2 * c.g
+		factorsG[k+3] += b3 * c.g
+		factorsB[k] += b0 * c.b
+		factorsB[k+1] += b1 * c.b
+		factorsB[k+2] += b2 * c.b
+		factorsB[k+3] += b3 * c.b
+	}
+}
 
+// normalizeFactors scales the accumulated factors of an image whose pixel weights sum to n.
+func normalizeFactors(factors []factor, n float64) {
+	factors[0].Scale(1 / n)
 	ac := factors[1:]
 	for i := range ac {
-		ac[i].Scale(2 / float64(imgH*imgW))
+		ac[i].Scale(2 / n)
 	}
+}
 
-	packedShape := (h-1)*9 + (w - 1)
-	dst = append1Base83(dst, packedShape)
+// appendFactors quantises the normalised factors and appends them to dst.
+func appendFactors(dst []byte, factors []factor, w, h int, cfg encodeConfig) []byte {
+	if cfg.compact {
+		return appendCompactFactors(dst, factors, w, h, cfg)
+	}
+	dc := factors[0]
+	ac := factors[1:]
+
+	start := len(dst)
+	dst = append1Base83(dst, PackShape(w, h))
+	if cfg.chromaScale != 1 {
+		for i := range ac {
+			ac[i] = scaleChroma(ac[i], cfg.chromaScale)
+		}
+	}
 	var max float64
 	if len(ac) > 0 {
 		actualMax := float64(0)
@@ -102,6 +416,7 @@ func Append(dst []byte, img image.Image, w, h int) []byte {
 			actualMax = math.Max(math.Abs(f.g), actualMax)
 			actualMax = math.Max(math.Abs(f.b), actualMax)
 		}
+		actualMax = math.Max(cfg.minMax, actualMax)
 		quantisedMax := int(clamp(0, 82, math.Floor(actualMax*166-0.5)))
 		max = float64(quantisedMax+1) / 166
 		dst = append1Base83(dst, quantisedMax)
@@ -109,16 +424,94 @@ func Append(dst []byte, img image.Image, w, h int) []byte {
 		max = 1
 		dst = append1Base83(dst, 0)
 	}
-	dst = append4Base83(dst, encodeDC(dc))
+	dst = append4Base83(dst, encodeDC(dc, cfg.rounding))
 	for i := range ac {
-		dst = append2Base83(dst, encodeAC(ac[i], max))
+		dst = append2Base83(dst, encodeAC(ac[i], max, cfg.rounding))
+	}
+	// Callers size buffers with EncodedLen, so it must stay in sync with the format.
+	if n := len(dst) - start; n != EncodedLen(w, h) {
+		panic(fmt.Sprintf("blurhash: internal error: encoded %d bytes for %dx%d components, EncodedLen is %d", n, w, h, EncodedLen(w, h)))
 	}
 	return dst
 }
 
-func Encode(img image.Image, w, h int) string {
+// scaleChroma scales the difference of each channel of f from its luma by s.
+func scaleChroma(f factor, s float64) factor {
+	y := 0.2126*f.r + 0.7152*f.g + 0.0722*f.b
+	return factor{
+		r: y + (f.r-y)*s,
+		g: y + (f.g-y)*s,
+		b: y + (f.b-y)*s,
+	}
+}
+
+// Encode returns the blurhash of img. It panics under the same conditions as Append.
+func Encode(img image.Image, w, h int, opts ...EncodeOption) string {
+	dst := make([]byte, 0, EncodedLen(w, h))
+	return string(Append(dst, img, w, h, opts...))
+}
+
+// EncodeWithColor is like Encode but also returns the average color of img,
+// as stored in the hash. It is the color DecodeAverageColor returns for the hash.
+func EncodeWithColor(img image.Image, w, h int, opts ...EncodeOption) (string, color.RGBA) {
+	cfg := newEncodeConfig(opts)
+	if err := checkEncode(img, w, h, cfg); err != nil {
+		panic(err)
+	}
 	dst := make([]byte, 0, EncodedLen(w, h))
-	return string(Append(dst, img, w, h))
+	dst, dc := appendImage(dst, img, w, h, cfg)
+	return string(dst), dcColor(dc)
+}
+
+// EncodeColor returns a blurhash with w x h components whose DC is c and whose
+// AC components are all zero, so it decodes to a solid color.
+// It panics if w or h is not in range 1..9, like Append.
+func EncodeColor(c color.Color, w, h int) string {
+	if !validComponents(w, h) {
+		panic(ErrInvalidComponents)
+	}
+	pR, pG, pB, _ := c.RGBA()
+	factors := make([]factor, 81)[:w*h]
+	factors[0] = factor{
+		r: sRGB((pR >> 8) & 0xff).linear(),
+		g: sRGB((pG >> 8) & 0xff).linear(),
+		b: sRGB((pB >> 8) & 0xff).linear(),
+	}
+	dst := make([]byte, 0, EncodedLen(w, h))
+	return string(appendFactors(dst, factors, w, h, newEncodeConfig(nil)))
+}
+
+// EncodeChecked is like Encode but returns an error instead of panicking.
+// It also rejects images with fewer pixels than components along either axis.
+func EncodeChecked(img image.Image, w, h int, opts ...EncodeOption) (string, error) {
+	cfg := newEncodeConfig(opts)
+	n, err := EncodedLenChecked(cfg.components(w, h))
+	if err != nil {
+		return "", err
+	}
+	if err := checkEncode(img, w, h, cfg); err != nil {
+		return "", err
+	}
+	if err := checkImageSize(img, w, h, cfg); err != nil {
+		return "", err
+	}
+	dst, _ := appendImage(make([]byte, 0, n), img, w, h, cfg)
+	return string(dst), nil
+}
+
+// PackShape returns the first digit of a hash with x horizontal and y vertical
+// components, (y-1)*9 + (x-1), as in the reference implementation.
+func PackShape(x, y int) int {
+	return (y-1)*9 + (x - 1)
+}
+
+// UnpackShape is the inverse of PackShape.
+func UnpackShape(v int) (x, y int) {
+	return v%9 + 1, v/9 + 1
+}
+
+func validComponents(w, h int) bool {
+	return 1 <= w && w <= 9 && 1 <= h && h <= 9
 }
 
 func EncodedLen(w, h int) int {
@@ -129,6 +522,54 @@ func EncodedLen(w, h int) int {
 	return packedShapeBytes + maxValueBytes + dcBytes + acBytes
 }
 
+// ComponentsForLength returns the component grid with the most components whose
+// hash is at most maxLen bytes long and whose shape follows aspect, the width of
+// the image divided by its height. Among grids with the same number of components
+// it prefers the one closest to aspect. Degenerate inputs give 1x1: a maxLen
+// less than 6, the length of a 1x1 hash, or an aspect that is not a positive finite number.
+func ComponentsForLength(maxLen int, aspect float64) (w, h int) {
+	if maxLen < EncodedLen(1, 1) || !(aspect > 0) || math.IsInf(aspect, 1) {
+		return 1, 1
+	}
+	// Beyond this range the grid is 9x1 or 1x9 anyway; clamping keeps the
+	// conversions below in range.
+	aspect = clamp(1.0/1024, 1024, aspect)
+	bestErr := math.Inf(1)
+	for y := 1; y <= 9; y++ {
+		for x := 1; x <= 9; x++ {
+			if EncodedLen(x, y) > maxLen {
+				continue
+			}
+			fitsX := x == maxInt(1, int(math.Round(float64(y)*aspect)))
+			fitsY := y == maxInt(1, int(math.Round(float64(x)/aspect)))
+			if !fitsX && !fitsY {
+				continue
+			}
+			ratioErr := math.Abs(math.Log(float64(x) / float64(y) / aspect))
+			if x*y > w*h || (x*y == w*h && ratioErr < bestErr) {
+				w, h, bestErr = x, y, ratioErr
+			}
+		}
+	}
+	return w, h
+}
+
+// EncodedLenChecked is like EncodedLen but returns ErrInvalidComponents
+// if w or h is not in range 1..9.
+func EncodedLenChecked(w, h int) (int, error) {
+	if !validComponents(w, h) {
+		return 0, ErrInvalidComponents
+	}
+	return EncodedLen(w, h), nil
+}
+
+// EncodeCost returns the number of multiply-adds the DCT performs when encoding
+// an imgW x imgH image with w x h components. It can be used to reject or
+// downscale images before encoding them.
+func EncodeCost(imgW, imgH, w, h int) (pixelOps int64) {
+	return int64(imgW) * int64(imgH) * int64(w) * int64(h) * 3
+}
+
 type factor struct {
 	r, g, b float64
 }
@@ -139,17 +580,30 @@ func (f *factor) Scale(v float64) {
 	f.b *= v
 }
 
-func encodeDC(dc factor) int {
-	roundedR := int(linear(dc.r).sRGB())
-	roundedG := int(linear(dc.g).sRGB())
-	roundedB := int(linear(dc.b).sRGB())
+func (f factor) absMax() float64 {
+	return math.Max(math.Abs(f.r), math.Max(math.Abs(f.g), math.Abs(f.b)))
+}
+
+func dcColor(dc factor) color.RGBA {
+	return color.RGBA{
+		R: linear(dc.r).sRGB(),
+		G: linear(dc.g).sRGB(),
+		B: linear(dc.b).sRGB(),
+		A: 0xff,
+	}
+}
+
+func encodeDC(dc factor, rounding Rounding) int {
+	roundedR := int(rounding.sRGB(linear(dc.r)))
+	roundedG := int(rounding.sRGB(linear(dc.g)))
+	roundedB := int(rounding.sRGB(linear(dc.b)))
 	return (roundedR << 16) | (roundedG << 8) | roundedB
 }
 
-func encodeAC(ac factor, max float64) int {
-	quantR := int(clamp(0, 18, math.Floor(signSqrt(ac.r/max)*9+9.5)))
-	quantG := int(clamp(0, 18, math.Floor(signSqrt(ac.g/max)*9+9.5)))
-	quantB := int(clamp(0, 18, math.Floor(signSqrt(ac.b/max)*9+9.5)))
+func encodeAC(ac factor, max float64, rounding Rounding) int {
+	quantR := int(clamp(0, 18, rounding.quantAC(signSqrt(ac.r/max))))
+	quantG := int(clamp(0, 18, rounding.quantAC(signSqrt(ac.g/max))))
+	quantB := int(clamp(0, 18, rounding.quantAC(signSqrt(ac.b/max))))
 	return quantR*(19*19) + quantG*19 + quantB
 }
 
@@ -166,6 +620,18 @@ func buildLinearTable() {
 	}
 }
 
+// Linearize converts an 8-bit sRGB value to linear light in range 0..1,
+// exactly as the encoder does.
+func Linearize(v uint8) float64 {
+	return sRGB(v).linear()
+}
+
+// Delinearize converts a linear value to 8-bit sRGB, exactly as the decoder does.
+// v is clamped to range 0..1. Delinearize(Linearize(v)) == v for every v.
+func Delinearize(v float64) uint8 {
+	return linear(v).sRGB()
+}
+
 type sRGB uint8
 
 func (value sRGB) linear() float64 {
@@ -175,11 +641,25 @@ func (value sRGB) linear() float64 {
 type linear float64
 
 func (value linear) sRGB() uint8 {
+	return uint8(clamp(0, 255, value.sRGB255()+0.5))
+}
+
+// sRGBDither converts value to sRGB, using t in range (0, 1) as the rounding threshold.
+func (value linear) sRGBDither(t float64) uint8 {
+	return uint8(clamp(0, 255, math.Floor(value.sRGB255()+t)))
+}
+
+func (value linear) sRGB16() uint16 {
+	return uint16(clamp(0, 65535, value.sRGB255()*257+0.5))
+}
+
+// sRGB255 returns value in sRGB scaled to 0..255 without rounding.
+func (value linear) sRGB255() float64 {
 	v := clamp(0, 1, float64(value))
 	if v <= 0.0031308 {
-		return uint8(clamp(0, 255, v*12.92*255+0.5))
+		return v * 12.92 * 255
 	} else {
-		return uint8(clamp(0, 255, 1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+		return (1.055*math.Pow(v, 1/2.4) - 0.055) * 255
 	}
 }
 
@@ -191,54 +671,96 @@ func signSqrt(value float64) float64 {
 	return math.Copysign(math.Sqrt(math.Abs(value)), value)
 }
 
-var base83chars = []byte("0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~")
+// Base83Alphabet is the set of characters used by blurhash, in digit order.
+const Base83Alphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+var base83Table [256]int8
+
+func buildBase83Table() {
+	for i := range base83Table {
+		base83Table[i] = -1
+	}
+	for i := 0; i < len(Base83Alphabet); i++ {
+		base83Table[Base83Alphabet[i]] = int8(i)
+	}
+}
+
+// IsValidBase83 reports whether every byte of s is in Base83Alphabet.
+// It does not check that s is a well-formed blurhash.
+func IsValidBase83(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if base83Table[s[i]] < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// The appendNBase83 functions panic if v does not fit in N digits,
+// rather than silently producing a corrupt hash.
 
 func append1Base83(dst []byte, v int) []byte {
-	return append(dst, base83chars[v%83])
+	if v < 0 || v >= 83 {
+		panic("blurhash: value out of range for 1 base83 digit")
+	}
+	return append(dst, Base83Alphabet[v])
 }
 
 func append2Base83(dst []byte, v int) []byte {
-	return append1Base83(append1Base83(dst, v/83), v)
+	if v < 0 || v >= 83*83 {
+		panic("blurhash: value out of range for 2 base83 digits")
+	}
+	return append1Base83(append1Base83(dst, v/83), v%83)
 }
 
 func append4Base83(dst []byte, v int) []byte {
-	return append2Base83(append2Base83(dst, v/(83*83)), v)
+	if v < 0 || v >= 83*83*83*83 {
+		panic("blurhash: value out of range for 4 base83 digits")
+	}
+	return append2Base83(append2Base83(dst, v/(83*83)), v%(83*83))
 }
 
-func fastAccessor(img image.Image) func(x, y int) (r, b, g, a uint32) {
+// fastAccessor returns a function reading the pixels of img, and whether it
+// avoids the generic At method.
+func fastAccessor(img image.Image) (at func(x, y int) (r, b, g, a uint32), fast bool) {
 	switch img := img.(type) {
 	case *image.YCbCr:
-		var yShift, xShift uint8
-		switch img.SubsampleRatio {
-		case image.YCbCrSubsampleRatio422:
-			xShift = 1
-		case image.YCbCrSubsampleRatio420:
-			yShift, xShift = 1, 1
-		case image.YCbCrSubsampleRatio440:
-			yShift = 1
-		case image.YCbCrSubsampleRatio411:
-			xShift = 2
-		case image.YCbCrSubsampleRatio410:
-			yShift, xShift = 1, 2
-		}
 		return func(x, y int) (r, b, g, a uint32) {
 			yi := img.YOffset(x, y)
-			ci := ((y>>yShift)-(img.Rect.Min.Y>>yShift))*img.CStride + ((x >> xShift) - (img.Rect.Min.X >> xShift))
+			ci := img.COffset(x, y)
 			return color.YCbCr{Y: img.Y[yi], Cb: img.Cb[ci], Cr: img.Cr[ci]}.RGBA()
-		}
+		}, true
+	case *image.Gray:
+		return func(x, y int) (r, b, g, a uint32) {
+			v := uint32(img.Pix[img.PixOffset(x, y)]) * 0x101
+			return v, v, v, 0xffff
+		}, true
+	case *image.Gray16:
+		return func(x, y int) (r, b, g, a uint32) {
+			i := img.PixOffset(x, y)
+			v := uint32(img.Pix[i])<<8 | uint32(img.Pix[i+1])
+			return v, v, v, 0xffff
+		}, true
+	case *image.Alpha:
+		return func(x, y int) (r, b, g, a uint32) {
+			v := uint32(img.Pix[img.PixOffset(x, y)]) * 0x101
+			return v, v, v, v
+		}, true
+	case *image.Alpha16:
+		return func(x, y int) (r, b, g, a uint32) {
+			i := img.PixOffset(x, y)
+			v := uint32(img.Pix[i])<<8 | uint32(img.Pix[i+1])
+			return v, v, v, v
+		}, true
 	case *image.NRGBA:
 		return func(x, y int) (r, b, g, a uint32) {
 			i := img.PixOffset(x, y)
 			s := img.Pix[i : i+4 : i+4]
 			return color.NRGBA{R: s[0], G: s[1], B: s[2], A: s[3]}.RGBA()
-		}
+		}, true
 	default:
 		return func(x, y int) (r, b, g, a uint32) {
 			return img.At(x, y).RGBA()
-		}
+		}, false
 	}
 }
-
-func rotate(sinA, cosA, sinB, cosB float64) (float64, float64) {
-	return sinA*cosB + cosA*sinB, cosA*cosB - sinA*sinB
-}
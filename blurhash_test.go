@@ -0,0 +1,1465 @@
+// Copyright 2021-2022 Nao Yonashiro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blurhash
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"math/rand"
+	"runtime"
+	"testing"
+)
+
+// gradientImage returns a w x h opaque image that gets redder to the right
+// and greener towards the bottom.
+func gradientImage(w, h int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{R: uint8(x * 255 / w), G: uint8(y * 255 / h), B: 0x80, A: 0xff})
+		}
+	}
+	return img
+}
+
+// solidImage returns a w x h image filled with c.
+func solidImage(w, h int, c color.Color) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, c)
+		}
+	}
+	return img
+}
+
+// detailImage returns a w x h opaque image with smooth but busy variation in
+// every channel, so that most components of its hash are significant.
+func detailImage(w, h int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			fx, fy := float64(x)/float64(w), float64(y)/float64(h)
+			r := 0.5 + 0.5*math.Sin(7*fx+3*fy)
+			g := 0.5 + 0.5*math.Cos(5*fy-4*fx*fy)
+			b := 0.5 + 0.5*math.Sin(11*fx*fx+9*fy)
+			img.SetNRGBA(x, y, color.NRGBA{R: uint8(r * 255), G: uint8(g * 255), B: uint8(b * 255), A: 0xff})
+		}
+	}
+	return img
+}
+
+func TestIsValidBase83(t *testing.T) {
+	tests := []struct {
+		s    string
+		want bool
+	}{
+		{"", true},
+		{Base83Alphabet, true},
+		{"LEHV6nWB2yk8pyo0adR*.7kCMdnj", true},
+		{"LEHV6nWB2yk8 pyo0adR*.7kCMdnj", false},
+		{" LEHV6nWB2yk8pyo0adR*.7kCMdnj", false},
+		{"LEHV6nWB2yk8pyo0adR*.7kCMdnj\n", false},
+		{"LEHV6nWB2yk8pyo0adR*.7kCMdné", false},
+		{"日本語", false},
+		{"\x00", false},
+		{"\xff", false},
+		{"\"'&<>!/\\`()", false},
+	}
+	for _, tt := range tests {
+		if got := IsValidBase83(tt.s); got != tt.want {
+			t.Errorf("IsValidBase83(%q) = %v, want %v", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestBase83Alphabet(t *testing.T) {
+	if len(Base83Alphabet) != 83 {
+		t.Fatalf("len(Base83Alphabet) = %d, want 83", len(Base83Alphabet))
+	}
+	seen := make(map[rune]bool)
+	for _, r := range Base83Alphabet {
+		if seen[r] {
+			t.Errorf("duplicate character %q in Base83Alphabet", r)
+		}
+		seen[r] = true
+	}
+	for b := 0; b < 256; b++ {
+		want := seen[rune(b)] && b < 0x80
+		if got := IsValidBase83(string([]byte{byte(b)})); got != want {
+			t.Errorf("IsValidBase83(%q) = %v, want %v", b, got, want)
+		}
+	}
+}
+
+func TestWithProgress(t *testing.T) {
+	img := gradientImage(31, 17)
+	var calls []int
+	Encode(img, 4, 3, WithProgress(func(done, total int) {
+		if total != 17 {
+			t.Errorf("total = %d, want 17", total)
+		}
+		calls = append(calls, done)
+	}))
+	if len(calls) != 17 {
+		t.Fatalf("progress called %d times, want 17", len(calls))
+	}
+	for i, done := range calls {
+		if done != i+1 {
+			t.Errorf("call %d: done = %d, want %d", i, done, i+1)
+		}
+	}
+}
+
+func TestEncodeComponentLimit(t *testing.T) {
+	img := gradientImage(32, 32)
+	hash := Encode(img, 9, 9)
+	if len(hash) != EncodedLen(9, 9) {
+		t.Errorf("len(Encode(img, 9, 9)) = %d, want %d", len(hash), EncodedLen(9, 9))
+	}
+	if x, y, err := Components(hash); err != nil || x != 9 || y != 9 {
+		t.Errorf("Components(%q) = %d, %d, %v, want 9, 9, nil", hash, x, y, err)
+	}
+
+	for _, c := range [][2]int{{9, 10}, {10, 9}, {0, 1}, {1, 0}, {-1, 3}} {
+		if _, err := EncodeChecked(img, c[0], c[1]); !errors.Is(err, ErrInvalidComponents) {
+			t.Errorf("EncodeChecked(img, %d, %d) error = %v, want ErrInvalidComponents", c[0], c[1], err)
+		}
+	}
+}
+
+func TestEncodePanicsOnInvalidComponents(t *testing.T) {
+	defer func() {
+		if err, _ := recover().(error); !errors.Is(err, ErrInvalidComponents) {
+			t.Errorf("Encode(img, 9, 10) panicked with %v, want ErrInvalidComponents", err)
+		}
+	}()
+	Encode(gradientImage(32, 32), 9, 10)
+}
+
+func TestEncodeSolid(t *testing.T) {
+	// The basis is not orthogonal over the pixel grid, so a solid image has
+	// non-zero AC components, which must round exactly like the reference encoder.
+	tests := []struct {
+		w, h int
+		c    color.NRGBA
+		x, y int
+		want string
+	}{
+		{17, 8, color.NRGBA{R: 255, G: 4, B: 184, A: 255}, 1, 3, "IfTJ28|ifQ"},
+	}
+	for _, tt := range tests {
+		if got := Encode(solidImage(tt.w, tt.h, tt.c), tt.x, tt.y); got != tt.want {
+			t.Errorf("Encode(%dx%d %v, %d, %d) = %q, want %q", tt.w, tt.h, tt.c, tt.x, tt.y, got, tt.want)
+		}
+	}
+}
+
+func TestEncodeSolidMatchesRowWriter(t *testing.T) {
+	colors := []color.NRGBA{
+		{R: 255, G: 4, B: 184, A: 255},
+		{R: 0, G: 0, B: 0, A: 255},
+		{R: 255, G: 255, B: 255, A: 255},
+		{R: 18, G: 200, B: 77, A: 255},
+	}
+	for _, c := range colors {
+		for imgW := 1; imgW <= 24; imgW += 3 {
+			for imgH := 1; imgH <= 24; imgH += 5 {
+				img := solidImage(imgW, imgH, c)
+				for y := 1; y <= 9; y++ {
+					for x := 1; x <= 9; x++ {
+						rw := NewRowWriter(imgW, imgH, x, y)
+						rgba := image.NewRGBA(img.Rect)
+						draw.Draw(rgba, rgba.Rect, img, image.Point{}, draw.Src)
+						if _, err := rw.Write(rgba.Pix); err != nil {
+							t.Fatal(err)
+						}
+						want, err := rw.Hash()
+						if err != nil {
+							t.Fatal(err)
+						}
+						if got := Encode(img, x, y); got != want {
+							t.Fatalf("Encode(%dx%d %v, %d, %d) = %q, want %q", imgW, imgH, c, x, y, got, want)
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestEncodeNearSolid(t *testing.T) {
+	c := color.NRGBA{R: 90, G: 120, B: 150, A: 255}
+	solid := Encode(solidImage(32, 24, c), 4, 3)
+	img := solidImage(32, 24, c)
+	for y := 20; y < 24; y++ {
+		for x := 28; x < 32; x++ {
+			img.Set(x, y, color.NRGBA{R: 130, G: 120, B: 150, A: 255})
+		}
+	}
+	near := Encode(img, 4, 3)
+	if near == solid {
+		t.Errorf("near-solid image encodes like the solid one: %q", near)
+	}
+	want, _ := DecodeAverageColor(solid)
+	got, err := DecodeAverageColor(near)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := int(got.R) - int(want.R); d < 0 || d > 2 || got.G != want.G || got.B != want.B {
+		t.Errorf("average color of near-solid image = %v, want close to %v", got, want)
+	}
+}
+
+func TestEncode1x1(t *testing.T) {
+	// A 1x1 hash holds only the DC component, so it decodes to the linear
+	// average of the image at any size.
+	for name, img := range referenceImages(t) {
+		hash := Encode(img, 1, 1)
+		if len(hash) != 6 {
+			t.Fatalf("%s: Encode(img, 1, 1) = %q, want 6 characters", name, hash)
+		}
+		if err := Validate(hash); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		var sum [3]float64
+		b := img.Bounds()
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				r, g, bl, _ := img.At(x, y).RGBA()
+				sum[0] += Linearize(uint8(r >> 8))
+				sum[1] += Linearize(uint8(g >> 8))
+				sum[2] += Linearize(uint8(bl >> 8))
+			}
+		}
+		n := float64(b.Dx() * b.Dy())
+		want := color.RGBA{R: Delinearize(sum[0] / n), G: Delinearize(sum[1] / n), B: Delinearize(sum[2] / n), A: 255}
+		for _, size := range []image.Point{{1, 1}, {5, 3}, {32, 32}} {
+			dec, err := Decode(hash, size.X, size.Y)
+			if err != nil {
+				t.Fatal(err)
+			}
+			first := dec.RGBAAt(0, 0)
+			if absInt(int(first.R)-int(want.R)) > 1 || absInt(int(first.G)-int(want.G)) > 1 || absInt(int(first.B)-int(want.B)) > 1 || first.A != 255 {
+				t.Errorf("%s: Decode(%q, %v) = %v, want close to the average %v", name, hash, size, first, want)
+			}
+			for i := 0; i < len(dec.Pix); i += 4 {
+				if got := (color.RGBA{R: dec.Pix[i], G: dec.Pix[i+1], B: dec.Pix[i+2], A: dec.Pix[i+3]}); got != first {
+					t.Fatalf("%s: Decode(%q, %v) is not solid: pixel %d = %v, want %v", name, hash, size, i/4, got, first)
+				}
+			}
+		}
+	}
+}
+
+func TestWithProgressSolid(t *testing.T) {
+	calls := 0
+	Encode(solidImage(20, 13, color.Gray{Y: 0x40}), 4, 3, WithProgress(func(done, total int) {
+		calls++
+		if done != calls || total != 13 {
+			t.Errorf("progress(%d, %d), want (%d, 13)", done, total, calls)
+		}
+	}))
+	if calls != 13 {
+		t.Errorf("progress called %d times, want 13", calls)
+	}
+}
+
+func TestQuantisedDigitsInRange(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	values := []float64{0, 1, -1, 0.5, -0.5, 2, -2, 1e9, -1e9, math.Inf(1), math.Inf(-1), math.SmallestNonzeroFloat64}
+	random := func() float64 {
+		if rng.Intn(4) == 0 {
+			return values[rng.Intn(len(values))]
+		}
+		return rng.NormFloat64()
+	}
+	for n := 0; n < 100000; n++ {
+		f := factor{r: random(), g: random(), b: random()}
+		rounding := Rounding(rng.Intn(2))
+		if v := encodeDC(f, rounding); v < 0 || v > 0xffffff {
+			t.Fatalf("encodeDC(%v) = %d, out of range 0..%d", f, v, 0xffffff)
+		}
+		max := float64(rng.Intn(83)+1) / 166
+		if v := encodeAC(f, max, rounding); v < 0 || v >= 19*19*19 {
+			t.Fatalf("encodeAC(%v, %v) = %d, out of range 0..%d", f, max, v, 19*19*19-1)
+		}
+	}
+}
+
+func TestAppendFactorsRandom(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	for n := 0; n < 10000; n++ {
+		w, h := rng.Intn(9)+1, rng.Intn(9)+1
+		factors := make([]factor, w*h)
+		for i := range factors {
+			scale := math.Pow(10, float64(rng.Intn(7)-3))
+			factors[i] = factor{r: rng.NormFloat64() * scale, g: rng.NormFloat64() * scale, b: rng.NormFloat64() * scale}
+		}
+		hash := string(appendFactors(nil, factors, w, h, newEncodeConfig(nil)))
+		if err := Validate(hash); err != nil {
+			t.Fatalf("appendFactors(%v) = %q: %v", factors, hash, err)
+		}
+	}
+}
+
+func TestAppendBase83Overflow(t *testing.T) {
+	tests := []struct {
+		name string
+		fn   func()
+	}{
+		{"append1Base83(83)", func() { append1Base83(nil, 83) }},
+		{"append1Base83(-1)", func() { append1Base83(nil, -1) }},
+		{"append2Base83(83*83)", func() { append2Base83(nil, 83*83) }},
+		{"append4Base83(83*83*83*83)", func() { append4Base83(nil, 83*83*83*83) }},
+	}
+	for _, tt := range tests {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s did not panic", tt.name)
+				}
+			}()
+			tt.fn()
+		}()
+	}
+	if got := string(append4Base83(nil, 83*83*83*83-1)); got != "~~~~" {
+		t.Errorf("append4Base83(83^4-1) = %q, want \"~~~~\"", got)
+	}
+}
+
+func TestEncodeWithColor(t *testing.T) {
+	images := []image.Image{
+		gradientImage(64, 48),
+		detailImage(31, 17),
+		solidImage(5, 5, color.NRGBA{R: 10, G: 200, B: 30, A: 255}),
+		image.NewUniform(color.RGBA{R: 0x12, G: 0x34, B: 0x56, A: 0xff}),
+	}
+	for i, img := range images {
+		hash, c := EncodeWithColor(img, 4, 3)
+		if want := Encode(img, 4, 3); hash != want {
+			t.Errorf("image %d: hash = %q, want %q", i, hash, want)
+		}
+		want, err := DecodeAverageColor(hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c != want {
+			t.Errorf("image %d: color = %v, want %v", i, c, want)
+		}
+	}
+}
+
+func TestEncodeUniform(t *testing.T) {
+	for _, c := range []color.RGBA{
+		{R: 0x12, G: 0x34, B: 0x56, A: 0xff},
+		{R: 0xff, G: 0xff, B: 0xff, A: 0xff},
+		{A: 0xff},
+	} {
+		hash, err := EncodeChecked(image.NewUniform(c), 4, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := DecodeAverageColor(hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != c {
+			t.Errorf("DecodeAverageColor(%q) = %v, want %v", hash, got, c)
+		}
+		if flat, err := IsFlat(hash, 0); err != nil || !flat {
+			t.Errorf("IsFlat(%q, 0) = %v, %v, want true", hash, flat, err)
+		}
+		if want := EncodeColor(c, 4, 3); hash != want {
+			t.Errorf("hash = %q, want %q like EncodeColor", hash, want)
+		}
+	}
+}
+
+func TestEncodeColor(t *testing.T) {
+	colors := []color.RGBA{{R: 0x12, G: 0x34, B: 0x56, A: 0xff}, {R: 0xff, G: 0x04, B: 0xb8, A: 0xff}}
+	for v := 0; v < 256; v++ {
+		colors = append(colors, color.RGBA{R: uint8(v), G: uint8(255 - v), B: uint8(v * 7), A: 0xff})
+	}
+	for _, c := range colors {
+		for _, grid := range [][2]int{{1, 1}, {4, 3}, {9, 9}} {
+			hash := EncodeColor(c, grid[0], grid[1])
+			if got, err := DecodeAverageColor(hash); err != nil || got != c {
+				t.Fatalf("DecodeAverageColor(EncodeColor(%v, %d, %d)) = %v, %v, want %v", c, grid[0], grid[1], got, err, c)
+			}
+			img, err := Decode(hash, 5, 4)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < len(img.Pix); i += 4 {
+				if got := (color.RGBA{R: img.Pix[i], G: img.Pix[i+1], B: img.Pix[i+2], A: img.Pix[i+3]}); got != c {
+					t.Fatalf("EncodeColor(%v, %d, %d) decodes to %v at offset %d", c, grid[0], grid[1], got, i)
+				}
+			}
+		}
+	}
+}
+
+func TestAppendLinearF32(t *testing.T) {
+	img := detailImage(40, 30)
+	const stride = 40*3 + 6
+	pix := make([]float32, stride*30)
+	for y := 0; y < 30; y++ {
+		for x := 0; x < 40; x++ {
+			c := img.NRGBAAt(x, y)
+			p := pix[y*stride+x*3:]
+			p[0], p[1], p[2] = float32(Linearize(c.R)), float32(Linearize(c.G)), float32(Linearize(c.B))
+		}
+	}
+	for _, c := range [][2]int{{4, 3}, {9, 9}, {1, 1}} {
+		want := Encode(img, c[0], c[1])
+		got := string(AppendLinearF32(nil, pix, stride, 40, 30, c[0], c[1]))
+		if got != want {
+			t.Errorf("AppendLinearF32 with %dx%d components = %q, want %q", c[0], c[1], got, want)
+		}
+	}
+
+	// Out-of-range values are clamped to 0..1.
+	over := []float32{2, -1, 0.5}
+	clamped := []float32{1, 0, 0.5}
+	if got, want := string(AppendLinearF32(nil, over, 3, 1, 1, 1, 1)), string(AppendLinearF32(nil, clamped, 3, 1, 1, 1, 1)); got != want {
+		t.Errorf("AppendLinearF32 of out-of-range values = %q, want %q", got, want)
+	}
+}
+
+func TestEncodeCost(t *testing.T) {
+	tests := []struct {
+		imgW, imgH, w, h int
+		want             int64
+	}{
+		{1, 1, 1, 1, 3},
+		{64, 48, 4, 3, 64 * 48 * 4 * 3 * 3},
+		{1920, 1080, 9, 9, 1920 * 1080 * 81 * 3},
+		{100000, 100000, 9, 9, 100000 * 100000 * 81 * 3},
+		{0, 100, 4, 3, 0},
+	}
+	for _, tt := range tests {
+		if got := EncodeCost(tt.imgW, tt.imgH, tt.w, tt.h); got != tt.want {
+			t.Errorf("EncodeCost(%d, %d, %d, %d) = %d, want %d", tt.imgW, tt.imgH, tt.w, tt.h, got, tt.want)
+		}
+	}
+}
+
+func TestEncodeGOMAXPROCS(t *testing.T) {
+	images := []image.Image{detailImage(257, 131), gradientImage(64, 48)}
+	encode := func() []string {
+		var hashes []string
+		for _, img := range images {
+			hashes = append(hashes, Encode(img, 4, 3), Encode(img, 9, 9))
+		}
+		return hashes
+	}
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(1))
+	want := encode()
+	runtime.GOMAXPROCS(8)
+	got := encode()
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("hash %d = %q with GOMAXPROCS 8, want %q as with GOMAXPROCS 1", i, got[i], want[i])
+		}
+	}
+}
+
+func TestRoundingDC(t *testing.T) {
+	tests := []struct {
+		v                linear
+		halfUp, halfEven uint8
+	}{
+		{0.00015176349177441873, 1, 0},
+		{0.00045529047532325625, 2, 2},
+		{0.0007588174588720937, 3, 2},
+		{0.0013658714259697686, 5, 4},
+		{0.0016693984095186062, 6, 6},
+	}
+	for _, tt := range tests {
+		if s := tt.v.sRGB255(); s != math.Floor(s)+0.5 {
+			t.Fatalf("%v maps to %v, want a .5 boundary", tt.v, s)
+		}
+		if got := RoundHalfUp.sRGB(tt.v); got != tt.halfUp {
+			t.Errorf("RoundHalfUp.sRGB(%v) = %d, want %d", tt.v, got, tt.halfUp)
+		}
+		if got := RoundHalfEven.sRGB(tt.v); got != tt.halfEven {
+			t.Errorf("RoundHalfEven.sRGB(%v) = %d, want %d", tt.v, got, tt.halfEven)
+		}
+	}
+}
+
+func TestRoundingAC(t *testing.T) {
+	tests := []struct {
+		v                float64
+		halfUp, halfEven float64
+	}{
+		{-0.5, 5, 4},
+		{0.5, 14, 14},
+		{-2.5 / 9, 7, 6},
+		{-0.25, 7, 7},
+		{-1, 0, 0},
+		{1, 18, 18},
+	}
+	for _, tt := range tests {
+		if got := RoundHalfUp.quantAC(tt.v); got != tt.halfUp {
+			t.Errorf("RoundHalfUp.quantAC(%v) = %v, want %v", tt.v, got, tt.halfUp)
+		}
+		if got := RoundHalfEven.quantAC(tt.v); got != tt.halfEven {
+			t.Errorf("RoundHalfEven.quantAC(%v) = %v, want %v", tt.v, got, tt.halfEven)
+		}
+	}
+}
+
+func TestEncodeACReference(t *testing.T) {
+	const max = 0.5
+	lo, mid := max*math.Pow(8.5/9, 2), max*math.Pow(0.5/9, 2)
+	// want was computed with the reference expression
+	// Math.floor(Math.max(0, Math.min(18, Math.floor(signPow(v / max, 0.5) * 9 + 9.5)))).
+	tests := []struct {
+		v    float64
+		want int
+	}{
+		{-2 * max, 0},
+		{-max, 0},
+		{-lo - 1e-12, 0},
+		{-lo + 1e-12, 1},
+		{-mid - 1e-12, 8},
+		{-mid + 1e-12, 9},
+		{-1e-300, 9},
+		{math.Copysign(0, -1), 9},
+		{0, 9},
+		{1e-300, 9},
+		{mid - 1e-12, 9},
+		{mid + 1e-12, 10},
+		{lo - 1e-12, 17},
+		{lo + 1e-12, 18},
+		{max, 18},
+		{2 * max, 18},
+	}
+	for _, tt := range tests {
+		if got := encodeAC(factor{r: tt.v, g: tt.v, b: tt.v}, max, RoundHalfUp); got != tt.want*(19*19+19+1) {
+			t.Errorf("encodeAC(%v) = %d, want %d for each channel", tt.v, got, tt.want)
+		}
+	}
+
+	// The same expression, transcribed, over a dense sweep.
+	reference := func(v, max float64) int {
+		sign := 1.0
+		if v/max < 0 {
+			sign = -1
+		}
+		return int(math.Floor(math.Max(0, math.Min(18, math.Floor(sign*math.Pow(math.Abs(v/max), 0.5)*9+9.5)))))
+	}
+	for _, max := range []float64{1.0 / 166, 0.5, 83.0 / 166} {
+		for i := -100000; i <= 100000; i++ {
+			v := float64(i) / 100000 * 1.5 * max
+			f := factor{r: v, g: -v, b: v / 3}
+			want := reference(f.r, max)*19*19 + reference(f.g, max)*19 + reference(f.b, max)
+			if got := encodeAC(f, max, RoundHalfUp); got != want {
+				t.Fatalf("encodeAC(%v, %v) = %d, want %d", f, max, got, want)
+			}
+		}
+	}
+}
+
+func TestPackShape(t *testing.T) {
+	// First characters of hashes produced by the reference implementation.
+	tests := []struct {
+		x, y int
+		want byte
+	}{
+		{1, 1, '0'},
+		{4, 3, 'L'},
+		{3, 4, 'T'},
+		{9, 1, '8'},
+		{1, 9, '='},
+		{9, 9, '|'},
+	}
+	for _, tt := range tests {
+		v := PackShape(tt.x, tt.y)
+		if got := Base83Alphabet[v]; got != tt.want {
+			t.Errorf("PackShape(%d, %d) = %d (%q), want %q", tt.x, tt.y, v, got, tt.want)
+		}
+	}
+	img := detailImage(32, 24)
+	for y := 1; y <= 9; y++ {
+		for x := 1; x <= 9; x++ {
+			v := PackShape(x, y)
+			if gx, gy := UnpackShape(v); gx != x || gy != y {
+				t.Errorf("UnpackShape(%d) = %d, %d, want %d, %d", v, gx, gy, x, y)
+			}
+			if hash := Encode(img, x, y); hash[0] != Base83Alphabet[v] {
+				t.Errorf("Encode(img, %d, %d) starts with %q, want %q", x, y, hash[0], Base83Alphabet[v])
+			}
+		}
+	}
+}
+
+func TestEncodeComponentOrder(t *testing.T) {
+	// A horizontal gradient from blue to red; the hashes were produced by the
+	// reference TypeScript implementation.
+	const w, h = 32, 24
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := uint8(x * 255 / (w - 1))
+			img.SetNRGBA(x, y, color.NRGBA{R: v, G: 0x40, B: 255 - v, A: 0xff})
+		}
+	}
+	tests := []struct {
+		x, y int
+		want string
+	}{
+		{4, 3, "L.HbW}2gw%W@oMWrjufRfQfQfQfQ"},
+		{3, 4, "T.HbW}2gw%oMWrjufQfQfQoMWrju"},
+	}
+	for _, tt := range tests {
+		if got := Encode(img, tt.x, tt.y); got != tt.want {
+			t.Errorf("Encode(img, %d, %d) = %q, want %q", tt.x, tt.y, got, tt.want)
+		}
+	}
+}
+
+// setSwitch sets the encoder switch p to v for the rest of the test or benchmark.
+func setSwitch(tb testing.TB, p *bool, v bool) {
+	old := *p
+	*p = v
+	tb.Cleanup(func() { *p = old })
+}
+
+func TestEncodeMatchesAoS(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	noise := image.NewNRGBA(image.Rect(0, 0, 37, 29))
+	rnd.Read(noise.Pix)
+	imgs := []*image.NRGBA{gradientImage(64, 48), detailImage(101, 67), noise}
+	want := map[*image.NRGBA][]string{}
+	for _, img := range imgs {
+		for h := 1; h <= 9; h++ {
+			for w := 1; w <= 9; w++ {
+				want[img] = append(want[img], Encode(img, w, h))
+			}
+		}
+	}
+	setSwitch(t, &accumulateAoS, true)
+	setSwitch(t, &useAccumulate4x3, false)
+	for _, img := range imgs {
+		for h := 1; h <= 9; h++ {
+			for w := 1; w <= 9; w++ {
+				if got := Encode(img, w, h); got != want[img][(h-1)*9+w-1] {
+					t.Errorf("Encode(%v, %d, %d) with an array of structs = %q, want %q", img.Bounds(), w, h, got, want[img][(h-1)*9+w-1])
+				}
+			}
+		}
+	}
+}
+
+// benchmarkEncodePhoto encodes the test photo as NRGBA with w x h components.
+func benchmarkEncodePhoto(b *testing.B, w, h int) {
+	img := readPNG(b, "photo.png")
+	nrgba := image.NewNRGBA(img.Bounds())
+	draw.Draw(nrgba, nrgba.Rect, img, img.Bounds().Min, draw.Src)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		Encode(nrgba, w, h)
+	}
+}
+
+// BenchmarkEncodeLayout compares the per-channel arrays appendLinear accumulates
+// into with the array of structs it used before.
+func BenchmarkEncodeLayout(b *testing.B) {
+	b.Run("SoA", func(b *testing.B) { benchmarkEncodePhoto(b, 9, 9) })
+	b.Run("AoS", func(b *testing.B) {
+		setSwitch(b, &accumulateAoS, true)
+		benchmarkEncodePhoto(b, 9, 9)
+	})
+}
+
+func TestComponentsForLength(t *testing.T) {
+	tests := []struct {
+		maxLen int
+		aspect float64
+		w, h   int
+	}{
+		{6, 1, 1, 1},
+		{10, 1, 1, 1},
+		{10, 3, 3, 1},
+		{20, 4.0 / 3, 3, 2},
+		{20, 0.1, 1, 8},
+		{28, 4.0 / 3, 4, 3},
+		{28, 3.0 / 4, 3, 4},
+		{28, 1, 3, 3},
+		{28, 16.0 / 9, 4, 2},
+		{50, 1, 4, 4},
+		{100, 16.0 / 9, 9, 5},
+		{166, 1, 9, 9},
+		{166, 4.0 / 3, 9, 7},
+		{1000, 100, 9, 1},
+	}
+	for _, tt := range tests {
+		if w, h := ComponentsForLength(tt.maxLen, tt.aspect); w != tt.w || h != tt.h {
+			t.Errorf("ComponentsForLength(%d, %.3f) = %dx%d, want %dx%d", tt.maxLen, tt.aspect, w, h, tt.w, tt.h)
+		}
+	}
+	for _, aspect := range []float64{0.1, 0.5, 1, 4.0 / 3, 16.0 / 9, 3} {
+		prev := 0
+		for maxLen := 6; maxLen <= 200; maxLen++ {
+			w, h := ComponentsForLength(maxLen, aspect)
+			if !validComponents(w, h) || EncodedLen(w, h) > maxLen {
+				t.Fatalf("ComponentsForLength(%d, %.3f) = %dx%d, longer than %d", maxLen, aspect, w, h, maxLen)
+			}
+			if w*h < prev {
+				t.Fatalf("ComponentsForLength(%d, %.3f) = %dx%d, fewer components than for a shorter length", maxLen, aspect, w, h)
+			}
+			prev = w * h
+		}
+	}
+}
+
+func TestComponentsForLengthDegenerate(t *testing.T) {
+	tests := []struct {
+		maxLen int
+		aspect float64
+		w, h   int
+	}{
+		{0, 1, 1, 1},
+		{-1, 1, 1, 1},
+		{math.MinInt32, 1, 1, 1},
+		{5, 1, 1, 1},
+		{math.MaxInt32, 1, 9, 9},
+		{1 << 30, 4.0 / 3, 9, 7},
+		{166, 0, 1, 1},
+		{166, -1, 1, 1},
+		{166, math.NaN(), 1, 1},
+		{166, math.Inf(1), 1, 1},
+		{166, math.Inf(-1), 1, 1},
+		{166, 1e-300, 1, 9},
+		{166, 1e300, 9, 1},
+	}
+	img := detailImage(16, 16)
+	for _, tt := range tests {
+		w, h := ComponentsForLength(tt.maxLen, tt.aspect)
+		if w != tt.w || h != tt.h {
+			t.Errorf("ComponentsForLength(%d, %v) = %dx%d, want %dx%d", tt.maxLen, tt.aspect, w, h, tt.w, tt.h)
+			continue
+		}
+		// The result is always usable by the encoder.
+		if _, err := EncodeChecked(img, w, h); err != nil {
+			t.Errorf("EncodeChecked with ComponentsForLength(%d, %v) = %dx%d: %v", tt.maxLen, tt.aspect, w, h, err)
+		}
+	}
+}
+
+func TestEncodedLen(t *testing.T) {
+	// Callers pre-size buffers with EncodedLen, so every encoder must append
+	// exactly that many bytes for every valid grid.
+	img := detailImage(32, 24)
+	pix := image.NewRGBA(img.Rect)
+	draw.Draw(pix, pix.Rect, img, image.Point{}, draw.Src)
+	prefix := []byte("prefix")
+	for h := 1; h <= 9; h++ {
+		for w := 1; w <= 9; w++ {
+			want := EncodedLen(w, h)
+			if want != 6+2*(w*h-1) {
+				t.Errorf("EncodedLen(%d, %d) = %d, want %d", w, h, want, 6+2*(w*h-1))
+			}
+			if got := len(Append(nil, img, w, h)); got != want {
+				t.Errorf("len(Append(nil, img, %d, %d)) = %d, want %d", w, h, got, want)
+			}
+			if got := len(Append(prefix, img, w, h)) - len(prefix); got != want {
+				t.Errorf("Append(prefix, img, %d, %d) appended %d bytes, want %d", w, h, got, want)
+			}
+			if got := len(AppendBytes(nil, pix.Pix, pix.Stride, 32, 24, w, h)); got != want {
+				t.Errorf("len(AppendBytes(nil, pix, %d, %d)) = %d, want %d", w, h, got, want)
+			}
+			if got := len(EncodeColor(color.White, w, h)); got != want {
+				t.Errorf("len(EncodeColor(white, %d, %d)) = %d, want %d", w, h, got, want)
+			}
+		}
+	}
+}
+
+func TestEncodedLenChecked(t *testing.T) {
+	tests := []struct {
+		w, h int
+		want int
+		err  error
+	}{
+		{1, 1, 6, nil},
+		{4, 3, 28, nil},
+		{9, 9, 166, nil},
+		{0, 3, 0, ErrInvalidComponents},
+		{4, 0, 0, ErrInvalidComponents},
+		{-1, -1, 0, ErrInvalidComponents},
+		{10, 3, 0, ErrInvalidComponents},
+		{4, 10, 0, ErrInvalidComponents},
+		{math.MaxInt32, math.MaxInt32, 0, ErrInvalidComponents},
+	}
+	for _, tt := range tests {
+		got, err := EncodedLenChecked(tt.w, tt.h)
+		if got != tt.want || err != tt.err {
+			t.Errorf("EncodedLenChecked(%d, %d) = %d, %v, want %d, %v", tt.w, tt.h, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestWithToneMap(t *testing.T) {
+	reinhard := func(r, g, b float64) (float64, float64, float64) {
+		return r / (1 + r), g / (1 + g), b / (1 + b)
+	}
+	identity := func(r, g, b float64) (float64, float64, float64) {
+		return r, g, b
+	}
+	for _, img := range []image.Image{gradientImage(64, 48), solidImage(16, 16, color.NRGBA{R: 0xff, G: 0xf0, B: 0xe0, A: 0xff})} {
+		plain := Encode(img, 4, 3)
+		if got := Encode(img, 4, 3, WithToneMap(identity)); got != plain {
+			t.Errorf("identity tone map: got %q, want %q", got, plain)
+		}
+		before, err := DecodeAverageColor(plain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		after, err := DecodeAverageColor(Encode(img, 4, 3, WithToneMap(reinhard)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if after.R >= before.R || after.G >= before.G || after.B >= before.B {
+			t.Errorf("Reinhard tone map: DC %v, want below %v", after, before)
+		}
+	}
+	hash := Encode(image.NewUniform(color.White), 4, 3, WithToneMap(reinhard))
+	got, err := DecodeAverageColor(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// White is 1 in linear space, which Reinhard maps to 0.5.
+	if w := linear(0.5).sRGB(); got.R != w || got.G != w || got.B != w {
+		t.Errorf("Reinhard tone map of white: DC %v, want gray %d", got, w)
+	}
+}
+
+func TestWithFocalWeight(t *testing.T) {
+	img := solidImage(64, 32, color.NRGBA{B: 0xff, A: 0xff})
+	draw.Draw(img, image.Rect(0, 0, 16, 32), image.NewUniform(color.NRGBA{R: 0xff, A: 0xff}), image.Point{}, draw.Src)
+	focal := image.Rect(0, 0, 16, 32)
+
+	plain := Encode(img, 4, 3)
+	if got := Encode(img, 4, 3, WithFocalWeight(focal, 1)); got != plain {
+		t.Errorf("weight 1: got %q, want %q", got, plain)
+	}
+	before, err := DecodeAverageColor(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, err := DecodeAverageColor(Encode(img, 4, 3, WithFocalWeight(focal, 10)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.R <= before.R || after.B >= before.B {
+		t.Errorf("DC with a red focal region = %v, want redder than %v", after, before)
+	}
+	// With the weight of the red quarter at 3, both colors contribute equally.
+	mid, err := DecodeAverageColor(Encode(img, 4, 3, WithFocalWeight(focal, 3)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mid.R != mid.B {
+		t.Errorf("DC with equal weights = %v, want equal red and blue", mid)
+	}
+}
+
+// genericImage hides the concrete type of an image from the fast accessors.
+type genericImage struct {
+	image.Image
+}
+
+func TestEncodeAccessorsAgree(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for _, ratio := range []image.YCbCrSubsampleRatio{image.YCbCrSubsampleRatio444, image.YCbCrSubsampleRatio422, image.YCbCrSubsampleRatio420} {
+		for _, r := range []image.Rectangle{image.Rect(0, 0, 37, 29), image.Rect(5, 3, 42, 32)} {
+			src := image.NewYCbCr(r, ratio)
+			rnd.Read(src.Y)
+			rnd.Read(src.Cb)
+			rnd.Read(src.Cr)
+			nrgba := image.NewNRGBA(r)
+			draw.Draw(nrgba, r, src, r.Min, draw.Src)
+			rgba := image.NewRGBA(r)
+			draw.Draw(rgba, r, src, r.Min, draw.Src)
+			images := []struct {
+				name string
+				img  image.Image
+			}{
+				{"YCbCr", src},
+				{"NRGBA", nrgba},
+				{"RGBA", rgba},
+				{"generic", genericImage{src}},
+			}
+			for _, grid := range [][2]int{{1, 1}, {4, 3}, {9, 9}} {
+				want := Encode(images[0].img, grid[0], grid[1])
+				for _, tt := range images[1:] {
+					if got := Encode(tt.img, grid[0], grid[1]); got != want {
+						t.Errorf("%v %v %dx%d: %s hash %q, YCbCr hash %q", ratio, r, grid[0], grid[1], tt.name, got, want)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestEncodeGrayAccessorsAgree(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	r := image.Rect(5, 3, 42, 32)
+	gray := image.NewGray(r)
+	rnd.Read(gray.Pix)
+	gray16 := image.NewGray16(r)
+	nrgba := image.NewNRGBA(r)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			v := gray.GrayAt(x, y).Y
+			gray16.SetGray16(x, y, color.Gray16{Y: uint16(v) * 0x101})
+			nrgba.SetNRGBA(x, y, color.NRGBA{R: v, G: v, B: v, A: 0xff})
+		}
+	}
+	images := []struct {
+		name string
+		img  image.Image
+	}{
+		{"Gray16", gray16},
+		{"NRGBA", nrgba},
+		{"generic", genericImage{gray}},
+	}
+	for _, grid := range [][2]int{{1, 1}, {4, 3}, {9, 9}} {
+		want := Encode(gray, grid[0], grid[1])
+		for _, tt := range images {
+			if got := Encode(tt.img, grid[0], grid[1]); got != want {
+				t.Errorf("%dx%d: %s hash %q, Gray hash %q", grid[0], grid[1], tt.name, got, want)
+			}
+		}
+	}
+}
+
+// scanImage returns a synthetic grayscale document scan: a slightly uneven
+// white page with lines of dark text, so most pixels share a few gray levels.
+func scanImage(w, h int) *image.Gray {
+	rnd := rand.New(rand.NewSource(1))
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := 235 + rnd.Intn(8)
+			if line := y % 24; line >= 8 && line < 18 && x > w/10 && x < w*9/10 && rnd.Intn(3) == 0 {
+				v = 30 + rnd.Intn(40)
+			}
+			img.Pix[y*img.Stride+x] = uint8(v)
+		}
+	}
+	return img
+}
+
+func TestEncodeGrayScan(t *testing.T) {
+	scan := scanImage(425, 550)
+	nrgba := image.NewNRGBA(scan.Rect)
+	draw.Draw(nrgba, nrgba.Rect, scan, image.Point{}, draw.Src)
+	for _, grid := range [][2]int{{1, 1}, {3, 4}, {9, 9}} {
+		if got, want := Encode(scan, grid[0], grid[1]), Encode(nrgba, grid[0], grid[1]); got != want {
+			t.Errorf("%dx%d: Gray hash %q, NRGBA hash %q", grid[0], grid[1], got, want)
+		}
+	}
+}
+
+func BenchmarkEncodeGrayScan(b *testing.B) {
+	scan := scanImage(850, 1100)
+	nrgba := image.NewNRGBA(scan.Rect)
+	draw.Draw(nrgba, nrgba.Rect, scan, image.Point{}, draw.Src)
+	for _, bm := range []struct {
+		name string
+		img  image.Image
+	}{{"Gray", scan}, {"NRGBA", nrgba}} {
+		b.Run(bm.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				Encode(bm.img, 3, 4)
+			}
+		})
+	}
+}
+
+// rmse returns the root-mean-square difference of the color channels of two
+// images of the same size.
+func rmse(a, b image.Image) float64 {
+	bounds := a.Bounds()
+	var sum float64
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r0, g0, b0, _ := a.At(x, y).RGBA()
+			r1, g1, b1, _ := b.At(x, y).RGBA()
+			for _, d := range []float64{float64(r0>>8) - float64(r1>>8), float64(g0>>8) - float64(g1>>8), float64(b0>>8) - float64(b1>>8)} {
+				sum += d * d
+			}
+		}
+	}
+	return math.Sqrt(sum / float64(bounds.Dx()*bounds.Dy()*3))
+}
+
+func TestWithMinMax(t *testing.T) {
+	const w, h = 64, 48
+	dark := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := uint8(8 + 6*math.Sin(float64(x)/10)*math.Cos(float64(y)/8))
+			dark.SetNRGBA(x, y, color.NRGBA{R: v, G: v + 2, B: v + 4, A: 0xff})
+		}
+	}
+	plain := Encode(dark, 4, 3)
+	shape, err := Shape(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := Encode(dark, 4, 3, WithMinMax(float64(shape.MaxValue)/166)); got != plain {
+		t.Errorf("WithMinMax below the actual maximum: got %q, want %q", got, plain)
+	}
+	for _, min := range []float64{0.02, 0.05, 0.1} {
+		hash := Encode(dark, 4, 3, WithMinMax(min))
+		shape, err := Shape(hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := int(math.Floor(min*166 - 0.5)); shape.MaxValue != want {
+			t.Errorf("WithMinMax(%v): quantised maximum %d, want %d", min, shape.MaxValue, want)
+		}
+		img, err := Decode(hash, w, h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e := rmse(img, dark); e > 2.5 {
+			t.Errorf("WithMinMax(%v): reconstruction error %.2f, want at most 2.5", min, e)
+		}
+	}
+}
+
+func TestWithSampleStride(t *testing.T) {
+	tests := []struct {
+		name  string
+		img   image.Image
+		limit float64
+	}{
+		{"photo", readPNG(t, "photo.png"), 8},
+		{"gradient", gradientImage(512, 512), 4},
+	}
+	for _, tt := range tests {
+		b := tt.img.Bounds()
+		full, err := Decode(Encode(tt.img, 4, 3), b.Dx(), b.Dy())
+		if err != nil {
+			t.Fatal(err)
+		}
+		sampled, err := Decode(Encode(tt.img, 4, 3, WithSampleStride(4)), b.Dx(), b.Dy())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e := rmse(full, sampled); e > tt.limit {
+			t.Errorf("%s: stride 4 decodes %.2f RMS away from stride 1, want at most %v", tt.name, e, tt.limit)
+		}
+	}
+}
+
+func BenchmarkEncodeSampleStride(b *testing.B) {
+	img := detailImage(1024, 1024)
+	for _, stride := range []int{1, 4} {
+		b.Run(fmt.Sprintf("stride%d", stride), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				Encode(img, 4, 3, WithSampleStride(stride))
+			}
+		})
+	}
+}
+
+func TestWithStrict(t *testing.T) {
+	alpha := image.NewAlpha(image.Rect(0, 0, 16, 16))
+	for i := range alpha.Pix {
+		alpha.Pix[i] = uint8(i)
+	}
+	tests := []struct {
+		name string
+		img  image.Image
+		ok   bool
+	}{
+		{"NRGBA", gradientImage(16, 16), true},
+		{"Gray", image.NewGray(image.Rect(0, 0, 16, 16)), true},
+		{"Paletted", image.NewPaletted(image.Rect(0, 0, 16, 16), color.Palette{color.Black, color.White}), true},
+		{"Alpha", alpha, false},
+		{"Alpha16", image.NewAlpha16(image.Rect(0, 0, 16, 16)), false},
+		{"Uniform RGBA", image.NewUniform(color.RGBA{R: 0x80, A: 0xff}), true},
+		{"Uniform Gray", image.NewUniform(color.Gray{Y: 0x80}), true},
+		{"Uniform white", image.White, true},
+		{"Uniform Alpha", image.NewUniform(color.Alpha{A: 0x80}), false},
+		{"Uniform custom", image.NewUniform(genericColor{color.RGBA{A: 0xff}}), false},
+	}
+	for _, tt := range tests {
+		hash, err := EncodeChecked(tt.img, 4, 3, WithStrict(true))
+		if tt.ok && err != nil {
+			t.Errorf("%s: EncodeChecked with WithStrict: %v", tt.name, err)
+		}
+		if !tt.ok && err == nil {
+			t.Errorf("%s: EncodeChecked with WithStrict = %q, want error", tt.name, hash)
+		}
+		if _, err := EncodeChecked(tt.img, 4, 3); err != nil {
+			t.Errorf("%s: EncodeChecked: %v", tt.name, err)
+		}
+	}
+}
+
+// genericColor hides the concrete type of a color.
+type genericColor struct {
+	color.Color
+}
+
+func TestWithTranspose(t *testing.T) {
+	img := detailImage(53, 31)
+	b := img.Bounds()
+	transposed := image.NewNRGBA(image.Rect(0, 0, b.Dy(), b.Dx()))
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			transposed.Set(y, x, img.At(x, y))
+		}
+	}
+	focal := image.Rect(5, 2, 20, 10)
+	for _, grid := range [][2]int{{4, 3}, {3, 4}, {9, 2}, {1, 1}} {
+		want := Encode(transposed, grid[0], grid[1])
+		if got := Encode(img, grid[0], grid[1], WithTranspose(true)); got != want {
+			t.Errorf("%dx%d: WithTranspose(true) = %q, want %q", grid[0], grid[1], got, want)
+		}
+		want = Encode(transposed, grid[0], grid[1], WithFocalWeight(image.Rect(focal.Min.Y, focal.Min.X, focal.Max.Y, focal.Max.X), 4))
+		if got := Encode(img, grid[0], grid[1], WithTranspose(true), WithFocalWeight(focal, 4)); got != want {
+			t.Errorf("%dx%d: WithTranspose(true) with a focal region = %q, want %q", grid[0], grid[1], got, want)
+		}
+	}
+	if got, want := Encode(img, 4, 3, WithTranspose(false)), Encode(img, 4, 3); got != want {
+		t.Errorf("WithTranspose(false) = %q, want %q", got, want)
+	}
+}
+
+// lightnessRMSE returns the root-mean-square difference of the CIE L* lightness
+// of two images of the same size, which tracks perceived luma detail.
+func lightnessRMSE(a, b image.Image) float64 {
+	lightness := func(c color.Color) float64 {
+		r, g, b, _ := c.RGBA()
+		y := 0.2126*Linearize(uint8(r>>8)) + 0.7152*Linearize(uint8(g>>8)) + 0.0722*Linearize(uint8(b>>8))
+		if y > 216.0/24389 {
+			return 116*math.Cbrt(y) - 16
+		}
+		return y * 24389 / 27
+	}
+	bounds := a.Bounds()
+	var sum float64
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			d := lightness(a.At(x, y)) - lightness(b.At(x, y))
+			sum += d * d
+		}
+	}
+	return math.Sqrt(sum / float64(bounds.Dx()*bounds.Dy()))
+}
+
+func TestWithChromaSubsample(t *testing.T) {
+	// Subtle luma detail under strong color detail, which sets the AC maximum.
+	const w, h = 64, 48
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			l := 0.5 + 0.04*math.Cos(2*math.Pi*float64(y)/h) + 0.03*math.Cos(3*math.Pi*float64(x)/w)
+			c := 0.4 * math.Cos(math.Pi*float64(x)/w)
+			img.SetNRGBA(x, y, color.NRGBA{
+				R: uint8(255 * clamp(0, 1, l+c)),
+				G: uint8(255 * clamp(0, 1, l-c*0.3)),
+				B: uint8(255 * clamp(0, 1, l-c)),
+				A: 0xff,
+			})
+		}
+	}
+	if got, want := Encode(img, 4, 3, WithChromaSubsample(1)), Encode(img, 4, 3); got != want {
+		t.Errorf("factor 1: got %q, want %q", got, want)
+	}
+	lstar := map[float64]float64{}
+	for _, factor := range []float64{1, 0.5, 0.25} {
+		hash := Encode(img, 4, 3, WithChromaSubsample(factor))
+		decoded, err := Decode(hash, w, h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lstar[factor] = lightnessRMSE(img, decoded)
+	}
+	for _, factor := range []float64{0.5, 0.25} {
+		if lstar[factor] >= lstar[1] {
+			t.Errorf("factor %v: L* error %.3f, want below %.3f at factor 1", factor, lstar[factor], lstar[1])
+		}
+	}
+}
+
+func TestWithBackground(t *testing.T) {
+	const w, h = 32, 24
+	nrgba := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := color.NRGBA{R: uint8(x * 8), G: uint8(y * 10), B: 0x80, A: 0xff}
+			switch {
+			case x < w/4:
+				// Transparent, with a stored color that must not leak into the hash.
+				c = color.NRGBA{R: 0xff, G: 0x00, B: 0xff, A: 0}
+			case x < w/2:
+				c.A = 0x80
+			}
+			nrgba.SetNRGBA(x, y, c)
+		}
+	}
+	for _, bg := range []color.Color{color.White, color.Black, color.RGBA{R: 0x20, G: 0x60, B: 0xa0, A: 0xff}} {
+		composited := image.NewRGBA(nrgba.Bounds())
+		draw.Draw(composited, composited.Bounds(), image.NewUniform(bg), image.Point{}, draw.Src)
+		draw.Draw(composited, composited.Bounds(), nrgba, image.Point{}, draw.Over)
+
+		got := Encode(nrgba, 4, 3, WithBackground(bg))
+		want := Encode(composited, 4, 3)
+		if got != want {
+			t.Errorf("background %v: got %q, want %q", bg, got, want)
+		}
+	}
+
+	// Without a background the transparent region counts as black.
+	black := image.NewRGBA(nrgba.Bounds())
+	draw.Draw(black, black.Bounds(), nrgba, image.Point{}, draw.Over)
+	if got, want := Encode(nrgba, 4, 3), Encode(black, 4, 3); got != want {
+		t.Errorf("no background: got %q, want %q", got, want)
+	}
+}
+
+func TestAppendBytesBGRA(t *testing.T) {
+	photo := readPNG(t, "photo.png")
+	rgba := image.NewRGBA(image.Rect(0, 0, photo.Bounds().Dx(), photo.Bounds().Dy()))
+	draw.Draw(rgba, rgba.Rect, photo, photo.Bounds().Min, draw.Src)
+	imgW, imgH := rgba.Rect.Dx(), rgba.Rect.Dy()
+
+	// Pad the rows to check that the stride is honoured.
+	stride := imgW*4 + 12
+	pix := make([]byte, stride*imgH)
+	bgra := make([]byte, stride*imgH)
+	for y := 0; y < imgH; y++ {
+		row := rgba.Pix[y*rgba.Stride : y*rgba.Stride+imgW*4]
+		copy(pix[y*stride:], row)
+		for x := 0; x < imgW; x++ {
+			p, q := row[x*4:x*4+4], bgra[y*stride+x*4:]
+			q[0], q[1], q[2], q[3] = p[2], p[1], p[0], p[3]
+		}
+	}
+	for _, grid := range [][2]int{{1, 1}, {4, 3}, {9, 9}} {
+		want := Encode(rgba, grid[0], grid[1])
+		if got := string(AppendBytes(nil, pix, stride, imgW, imgH, grid[0], grid[1])); got != want {
+			t.Errorf("AppendBytes %dx%d = %q, want %q", grid[0], grid[1], got, want)
+		}
+		if got := string(AppendBytesBGRA(nil, bgra, stride, imgW, imgH, grid[0], grid[1])); got != want {
+			t.Errorf("AppendBytesBGRA %dx%d = %q, want %q", grid[0], grid[1], got, want)
+		}
+	}
+}
+
+func TestWithSlowPathHook(t *testing.T) {
+	var names []string
+	hook := WithSlowPathHook(func(modelName string) {
+		names = append(names, modelName)
+	})
+	Encode(genericImage{detailImage(32, 24)}, 4, 3, hook)
+	if len(names) != 1 || names[0] != "blurhash.genericImage" {
+		t.Errorf("hook called with %q, want once with %q", names, "blurhash.genericImage")
+	}
+
+	names = nil
+	for _, img := range []image.Image{
+		detailImage(32, 24),
+		image.NewGray(image.Rect(0, 0, 32, 24)),
+		image.NewYCbCr(image.Rect(0, 0, 32, 24), image.YCbCrSubsampleRatio420),
+	} {
+		Encode(img, 4, 3, hook)
+	}
+	if len(names) != 0 {
+		t.Errorf("hook called with %q for images with a fast accessor", names)
+	}
+}
+
+func TestLinearize(t *testing.T) {
+	prev := -1.0
+	for v := 0; v < 256; v++ {
+		l := Linearize(uint8(v))
+		if !(l > prev) || l > 1 {
+			t.Errorf("Linearize(%d) = %v, want increasing in range 0..1", v, l)
+		}
+		prev = l
+		if got := Delinearize(l); got != uint8(v) {
+			t.Errorf("Delinearize(Linearize(%d)) = %d", v, got)
+		}
+		if want := sRGB(v).linear(); l != want {
+			t.Errorf("Linearize(%d) = %v, want %v like the encoder", v, l, want)
+		}
+	}
+	for _, tt := range []struct {
+		v    float64
+		want uint8
+	}{{-0.5, 0}, {0, 0}, {1, 255}, {1.5, 255}} {
+		if got := Delinearize(tt.v); got != tt.want {
+			t.Errorf("Delinearize(%v) = %d, want %d", tt.v, got, tt.want)
+		}
+	}
+}
+
+func TestEncodeAlphaMask(t *testing.T) {
+	const w, h = 40, 30
+	mask := image.NewAlpha(image.Rect(0, 0, w, h))
+	mask16 := image.NewAlpha16(mask.Rect)
+	gray := image.NewGray(mask.Rect)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := uint8((x + y) * 255 / (w + h - 2))
+			mask.SetAlpha(x, y, color.Alpha{A: v})
+			mask16.SetAlpha16(x, y, color.Alpha16{A: uint16(v) * 0x101})
+			gray.SetGray(x, y, color.Gray{Y: v})
+		}
+	}
+	// The mask encodes as the opaque gray image of its alpha, not as transparent black.
+	want := Encode(gray, 4, 3)
+	if got := Encode(mask, 4, 3); got != want {
+		t.Errorf("Encode(*image.Alpha) = %q, want %q", got, want)
+	}
+	if got := Encode(mask16, 4, 3); got != want {
+		t.Errorf("Encode(*image.Alpha16) = %q, want %q", got, want)
+	}
+	if got := string(AppendScratch(nil, mask, 4, 3, &Scratch{})); got != want {
+		t.Errorf("AppendScratch(*image.Alpha) = %q, want %q", got, want)
+	}
+	if _, err := EncodeChecked(mask, 4, 3, WithStrict(true)); err == nil {
+		t.Error("EncodeChecked(*image.Alpha) succeeded with WithStrict, want error")
+	}
+}
+
+func TestWithMaxComponents(t *testing.T) {
+	img := detailImage(32, 24)
+	pix := image.NewRGBA(img.Rect)
+	draw.Draw(pix, pix.Rect, img, image.Point{}, draw.Src)
+	bgra := append([]byte(nil), pix.Pix...)
+	lin := make([]float32, 0, 32*24*3)
+	for i := 0; i < len(bgra); i += 4 {
+		bgra[i], bgra[i+2] = bgra[i+2], bgra[i]
+		lin = append(lin, float32(Linearize(pix.Pix[i])), float32(Linearize(pix.Pix[i+1])), float32(Linearize(pix.Pix[i+2])))
+	}
+	for _, limit := range [][2]int{{8, 3}, {3, 8}, {1, 9}, {9, 1}, {0, 20}} {
+		maxX := int(clamp(1, 9, float64(limit[0])))
+		maxY := int(clamp(1, 9, float64(limit[1])))
+		for w := 1; w <= 12; w++ {
+			for h := 1; h <= 12; h++ {
+				hash, err := EncodeChecked(img, w, h, WithMaxComponents(limit[0], limit[1]))
+				if err != nil {
+					t.Fatalf("EncodeChecked(%d, %d, WithMaxComponents(%d, %d)): %v", w, h, limit[0], limit[1], err)
+				}
+				x, y, err := Components(hash)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if x > maxX || y > maxY {
+					t.Fatalf("EncodeChecked(%d, %d, WithMaxComponents(%d, %d)) has %dx%d components", w, h, limit[0], limit[1], x, y)
+				}
+				if want := Encode(img, minInt(w, maxX), minInt(h, maxY)); hash != want {
+					t.Fatalf("EncodeChecked(%d, %d, WithMaxComponents(%d, %d)) = %q, want %q", w, h, limit[0], limit[1], hash, want)
+				}
+				if got := Encode(img, w, h, WithMaxComponents(limit[0], limit[1])); got != hash {
+					t.Fatalf("Encode(%d, %d, WithMaxComponents(%d, %d)) = %q, want %q", w, h, limit[0], limit[1], got, hash)
+				}
+				// The byte and float entry points apply the limit before validating too.
+				opt := WithMaxComponents(limit[0], limit[1])
+				for name, got := range map[string]string{
+					"AppendBytes":     string(AppendBytes(nil, pix.Pix, pix.Stride, 32, 24, w, h, opt)),
+					"AppendBytesBGRA": string(AppendBytesBGRA(nil, bgra, pix.Stride, 32, 24, w, h, opt)),
+					"AppendLinearF32": string(AppendLinearF32(nil, lin, 32*3, 32, 24, w, h, opt)),
+				} {
+					if got != hash {
+						t.Fatalf("%s(%d, %d, WithMaxComponents(%d, %d)) = %q, want %q", name, w, h, limit[0], limit[1], got, hash)
+					}
+				}
+			}
+		}
+	}
+	// The limits do not make an invalid grid valid, and there are none by default.
+	for _, grid := range [][2]int{{0, 3}, {4, -1}} {
+		if _, err := EncodeChecked(img, grid[0], grid[1], WithMaxComponents(8, 3)); !errors.Is(err, ErrInvalidComponents) {
+			t.Errorf("EncodeChecked(%dx%d) error %v, want ErrInvalidComponents", grid[0], grid[1], err)
+		}
+	}
+	if _, err := EncodeChecked(img, 12, 5); !errors.Is(err, ErrInvalidComponents) {
+		t.Errorf("EncodeChecked(12x5) without limits: error %v, want ErrInvalidComponents", err)
+	}
+}
+
+func TestEncodeImageSmallerThanGrid(t *testing.T) {
+	small := detailImage(2, 2)
+	if _, err := EncodeChecked(small, 9, 9); err == nil {
+		t.Error("EncodeChecked of a 2x2 image with 9x9 components succeeded, want error")
+	}
+	if _, err := new(Encoder).Encode(small, 9, 9); err == nil {
+		t.Error("Encoder.Encode of a 2x2 image with 9x9 components succeeded, want error")
+	}
+	// Encode keeps accepting it, for compatibility with the reference encoder.
+	if hash := Encode(small, 9, 9); len(hash) != EncodedLen(9, 9) {
+		t.Errorf("Encode(2x2, 9, 9) = %q, want %d characters", hash, EncodedLen(9, 9))
+	}
+	// Clamping the grid to the image size, as the error suggests, is accepted.
+	hash, err := EncodeChecked(small, 9, 9, WithMaxComponents(2, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := Encode(small, 2, 2); hash != want {
+		t.Errorf("EncodeChecked(2x2, 9, 9, WithMaxComponents(2, 2)) = %q, want %q", hash, want)
+	}
+	// The grid is compared with the image after WithTranspose.
+	tall := detailImage(2, 9)
+	if _, err := EncodeChecked(tall, 9, 2, WithTranspose(true)); err != nil {
+		t.Errorf("EncodeChecked(2x9, 9, 2, WithTranspose(true)): %v", err)
+	}
+	if _, err := EncodeChecked(tall, 9, 2); err == nil {
+		t.Error("EncodeChecked(2x9, 9, 2) succeeded, want error")
+	}
+}
+
+func TestAccumulate4x3(t *testing.T) {
+	photo := readPNG(t, "photo.png")
+	nrgba := image.NewNRGBA(photo.Bounds())
+	draw.Draw(nrgba, nrgba.Rect, photo, photo.Bounds().Min, draw.Src)
+	imgs := []*image.NRGBA{nrgba, detailImage(101, 67), gradientImage(64, 48)}
+	want := make([]string, len(imgs))
+	for i, img := range imgs {
+		want[i] = Encode(img, 4, 3)
+	}
+	setSwitch(t, &useAccumulate4x3, false)
+	for i, img := range imgs {
+		if got := Encode(img, 4, 3); got != want[i] {
+			t.Errorf("Encode(%v, 4, 3) = %q with the general loop, want %q as with accumulate4x3", img.Bounds(), got, want[i])
+		}
+	}
+}
+
+// BenchmarkEncodePhoto4x3 compares the encoder with and without accumulate4x3.
+func BenchmarkEncodePhoto4x3(b *testing.B) {
+	b.Run("unrolled", func(b *testing.B) { benchmarkEncodePhoto(b, 4, 3) })
+	b.Run("general", func(b *testing.B) {
+		setSwitch(b, &useAccumulate4x3, false)
+		benchmarkEncodePhoto(b, 4, 3)
+	})
+}
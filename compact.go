@@ -0,0 +1,129 @@
+// Copyright 2021-2022 Nao Yonashiro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blurhash
+
+import (
+	"fmt"
+	"image"
+	"math"
+)
+
+// The compact format is a non-standard variant of blurhash produced by
+// EncodeCompact. It has the same size flag, maximum AC value and DC component,
+// but each AC component is a single base83 digit holding only its luma,
+// quantised to 83 levels. It is about half as long as a standard hash for the
+// same components, at the cost of color detail. Compact hashes cannot be read by
+// standard blurhash decoders.
+
+// EncodeCompact is like Encode but returns a hash in the compact format,
+// which only DecodeCompact can read.
+func EncodeCompact(img image.Image, w, h int, opts ...EncodeOption) string {
+	cfg := newEncodeConfig(opts)
+	if err := checkEncode(img, w, h, cfg); err != nil {
+		panic(err)
+	}
+	cfg.compact = true
+	dst := make([]byte, 0, compactLen(w, h))
+	dst, _ = appendImage(dst, img, w, h, cfg)
+	return string(dst)
+}
+
+// DecodeCompact is like Decode but reads a hash produced by EncodeCompact.
+// The AC components have no chroma, so the detail of the image is gray
+// around its average color.
+func DecodeCompact(hash string, width, height int, opts ...DecodeOption) (*image.RGBA, error) {
+	cfg, err := newDecodeConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := parseCompact(cfg.normalize(hash))
+	if err != nil {
+		return nil, err
+	}
+	return parsed.Decode(width, height, opts...)
+}
+
+func compactLen(w, h int) int {
+	return 1 + 1 + 4 + (w*h - 1)
+}
+
+// appendCompactFactors is like appendFactors but writes the compact format.
+func appendCompactFactors(dst []byte, factors []factor, w, h int, cfg encodeConfig) []byte {
+	dc := factors[0]
+	ac := factors[1:]
+
+	dst = append1Base83(dst, PackShape(w, h))
+	lumas := make([]float64, len(ac))
+	actualMax := cfg.minMax
+	for i, f := range ac {
+		lumas[i] = 0.2126*f.r + 0.7152*f.g + 0.0722*f.b
+		actualMax = math.Max(math.Abs(lumas[i]), actualMax)
+	}
+	max := float64(1)
+	if len(ac) > 0 {
+		quantisedMax := int(clamp(0, 82, math.Floor(actualMax*166-0.5)))
+		max = float64(quantisedMax+1) / 166
+		dst = append1Base83(dst, quantisedMax)
+	} else {
+		dst = append1Base83(dst, 0)
+	}
+	dst = append4Base83(dst, encodeDC(dc, cfg.rounding))
+	for _, y := range lumas {
+		dst = append1Base83(dst, int(clamp(0, 82, math.Floor(signSqrt(y/max)*41+41.5))))
+	}
+	return dst
+}
+
+// parseCompact is like Parse but reads the compact format.
+func parseCompact(hash string) (*Parsed, error) {
+	if len(hash) < 6 {
+		return nil, truncatedError(len(hash))
+	}
+	sizeFlag, err := readBase83(hash, 0, 1)
+	if err != nil {
+		return nil, err
+	}
+	numX, numY := UnpackShape(sizeFlag)
+	if !validComponents(numX, numY) {
+		return nil, fmt.Errorf("%w: size flag %d out of range", ErrInvalidHash, sizeFlag)
+	}
+	if want := compactLen(numX, numY); len(hash) != want {
+		return nil, fmt.Errorf("%w: compact hash length %d, want %d for %dx%d components", ErrInvalidHash, len(hash), want, numX, numY)
+	}
+	quantisedMax, err := readBase83(hash, 1, 1)
+	if err != nil {
+		return nil, err
+	}
+	parsed := &Parsed{
+		numX:    numX,
+		numY:    numY,
+		max:     float64(quantisedMax+1) / 166,
+		factors: make([]factor, numX*numY),
+	}
+	dc, err := readBase83(hash, 2, 4)
+	if err != nil {
+		return nil, err
+	}
+	parsed.factors[0] = decodeDC(dc)
+	for i := 1; i < len(parsed.factors); i++ {
+		q, err := readBase83(hash, 5+i, 1)
+		if err != nil {
+			return nil, err
+		}
+		y := signPow2(float64(q-41)/41) * parsed.max
+		parsed.factors[i] = factor{r: y, g: y, b: y}
+	}
+	return parsed, nil
+}
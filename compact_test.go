@@ -0,0 +1,65 @@
+// Copyright 2021-2022 Nao Yonashiro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blurhash
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCompactRoundTrip(t *testing.T) {
+	imgs := referenceImages(t)
+	for _, name := range []string{"gray ramp", "gray photo", "photo", "gradient"} {
+		img := imgs[name]
+		for _, grid := range [][2]int{{1, 1}, {4, 3}, {9, 9}} {
+			w, h := grid[0], grid[1]
+			compact := EncodeCompact(img, w, h)
+			standard := Encode(img, w, h)
+			if got, want := len(compact), len(standard)-(w*h-1); got != want {
+				t.Errorf("%s %dx%d: compact length %d, want %d for standard length %d", name, w, h, got, want, len(standard))
+			}
+
+			// The size flag and the DC are stored alike; only the AC differs.
+			if compact[0] != standard[0] || compact[2:6] != standard[2:6] {
+				t.Errorf("%s %dx%d: size or DC of %q differs from %q", name, w, h, compact, standard)
+			}
+			got, err := DecodeCompact(compact, 32, 24)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, err := Decode(standard, 32, 24)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if e := lightnessRMSE(got, want); e > 4 {
+				t.Errorf("%s %dx%d: L* error %.2f against the standard hash, want at most 4", name, w, h, e)
+			}
+		}
+	}
+}
+
+func TestDecodeCompactInvalid(t *testing.T) {
+	compact := EncodeCompact(detailImage(32, 24), 4, 3)
+	for _, hash := range []string{
+		"",
+		compact[:len(compact)-1],
+		compact + "0",
+		Encode(detailImage(32, 24), 4, 3),
+	} {
+		if _, err := DecodeCompact(hash, 32, 24); !errors.Is(err, ErrInvalidHash) {
+			t.Errorf("DecodeCompact(%q) error %v, want ErrInvalidHash", hash, err)
+		}
+	}
+}
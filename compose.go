@@ -0,0 +1,78 @@
+// Copyright 2021-2022 Nao Yonashiro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blurhash
+
+// composeSize is the size per axis at which hashes are rendered to be recombined.
+const composeSize = 32
+
+// ConcatHorizontal returns a hash approximating the images of left and right,
+// assumed to be the same size, placed side by side. Both are rendered in linear
+// light and the result is re-encoded with as many horizontal components as the
+// two hashes together, up to 9, and as many vertical components as the larger.
+// The result is approximate: detail beyond its components is lost.
+func ConcatHorizontal(left, right string) (string, error) {
+	l, err := Parse(left)
+	if err != nil {
+		return "", err
+	}
+	r, err := Parse(right)
+	if err != nil {
+		return "", err
+	}
+
+	pix := make([]factor, 2*composeSize*composeSize)
+	l.render(composeSize, composeSize, func(x, y int, c factor) {
+		pix[y*2*composeSize+x] = c
+	})
+	r.render(composeSize, composeSize, func(x, y int, c factor) {
+		pix[y*2*composeSize+composeSize+x] = c
+	})
+	w := minInt(9, l.numX+r.numX)
+	h := maxInt(l.numY, r.numY)
+	return encodePlane(pix, 2*composeSize, 2*composeSize, composeSize, w, h), nil
+}
+
+// SplitHorizontal returns hashes approximating the left and right halves of the
+// image represented by hash. The image is rendered in linear light and each half
+// is re-encoded with half of the horizontal components, rounded up, and all of the
+// vertical ones. The result is approximate: ConcatHorizontal of the halves only
+// roughly recovers hash.
+func SplitHorizontal(hash string) (left, right string, err error) {
+	parsed, err := Parse(hash)
+	if err != nil {
+		return "", "", err
+	}
+
+	pix := make([]factor, 2*composeSize*composeSize)
+	parsed.render(2*composeSize, composeSize, func(x, y int, c factor) {
+		pix[y*2*composeSize+x] = c
+	})
+	w := (parsed.numX + 1) / 2
+	left = encodePlane(pix, 2*composeSize, composeSize, composeSize, w, parsed.numY)
+	right = encodePlane(pix[composeSize:], 2*composeSize, composeSize, composeSize, w, parsed.numY)
+	return left, right, nil
+}
+
+// encodePlane encodes the imgW x imgH linear pixels at pix[y*stride+x],
+// clamped to range 0..1, with w x h components.
+func encodePlane(pix []factor, stride, imgW, imgH, w, h int) string {
+	at := func(x, y int) factor {
+		c := pix[y*stride+x]
+		return factor{r: clamp(0, 1, c.r), g: clamp(0, 1, c.g), b: clamp(0, 1, c.b)}
+	}
+	dst := make([]byte, 0, EncodedLen(w, h))
+	dst, _ = appendLinear(dst, at, imgW, imgH, w, h, newEncodeConfig(nil))
+	return string(dst)
+}
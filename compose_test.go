@@ -0,0 +1,166 @@
+// Copyright 2021-2022 Nao Yonashiro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blurhash
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"testing"
+)
+
+func TestConcatHorizontal(t *testing.T) {
+	left := Encode(gradientImage(32, 32), 4, 3)
+	right := EncodeColor(color.RGBA{R: 0x20, G: 0x40, B: 0xc0, A: 0xff}, 3, 3)
+	hash, err := ConcatHorizontal(left, right)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if x, y, _ := Components(hash); x != 7 || y != 3 {
+		t.Errorf("ConcatHorizontal has %dx%d components, want 7x3", x, y)
+	}
+	img, err := Decode(hash, 64, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := map[string]image.Image{}
+	for _, h := range []string{left, right} {
+		if decoded[h], err = Decode(h, 32, 32); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Ringing at the seam makes the halves differ from the inputs pixel by pixel,
+	// but each must keep the average color of its input and be closer to it than
+	// to the other input.
+	halves := []struct {
+		name        string
+		rect        image.Rectangle
+		hash, other string
+	}{
+		{"left", image.Rect(0, 0, 32, 32), left, right},
+		{"right", image.Rect(32, 0, 64, 32), right, left},
+	}
+	for _, half := range halves {
+		got := translate(img.SubImage(half.rect))
+		m, want := meanColor(got), meanColor(decoded[half.hash])
+		for c := range m {
+			if math.Abs(m[c]-want[c]) > 10 {
+				t.Errorf("%s half: average color %.1f, want %.1f", half.name, m, want)
+				break
+			}
+		}
+		if own, other := rmse(got, decoded[half.hash]), rmse(got, decoded[half.other]); own >= other {
+			t.Errorf("%s half: RMSE %.1f to its input, %.1f to the other", half.name, own, other)
+		}
+	}
+	if _, err := ConcatHorizontal(left, "invalid"); err == nil {
+		t.Error("ConcatHorizontal with an invalid hash succeeded, want error")
+	}
+}
+
+func TestSplitHorizontal(t *testing.T) {
+	hashes := []string{
+		"LEHV6nWB2yk8pyo0adR*.7kCMdnj",
+		Encode(readPNG(t, "photo.png"), 8, 3),
+		Encode(detailImage(64, 48), 6, 4),
+		Encode(gradientImage(64, 32), 4, 3),
+	}
+	for _, hash := range hashes {
+		left, right, err := SplitHorizontal(hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		numX, numY, _ := Components(hash)
+		for _, half := range []string{left, right} {
+			if x, y, _ := Components(half); x != (numX+1)/2 || y != numY {
+				t.Errorf("SplitHorizontal(%q) half %q has %dx%d components, want %dx%d", hash, half, x, y, (numX+1)/2, numY)
+			}
+		}
+		orig, err := Decode(hash, 64, 32)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Each half decodes close to the same half of the original.
+		for i, half := range []string{left, right} {
+			img, err := Decode(half, 32, 32)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := translate(orig.SubImage(image.Rect(32*i, 0, 32*i+32, 32)))
+			if e := rmse(img, want); e > 25 {
+				t.Errorf("SplitHorizontal(%q) half %d is %.1f RMSE from the original, want at most 25", hash, i, e)
+			}
+		}
+		// Concatenating the halves approximately recovers the original, much
+		// closer than a flat image of its average color.
+		joined, err := ConcatHorizontal(left, right)
+		if err != nil {
+			t.Fatal(err)
+		}
+		back, err := Decode(joined, 64, 32)
+		if err != nil {
+			t.Fatal(err)
+		}
+		avg, _ := DecodeAverageColor(hash)
+		flat, err := Decode(EncodeColor(avg, 1, 1), 64, 32)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e, base := rmse(back, orig), rmse(flat, orig); e > 0.6*base {
+			t.Errorf("ConcatHorizontal(SplitHorizontal(%q)) = %q is %.1f RMSE from the original, want well below %.1f of a flat image", hash, joined, e, base)
+		}
+		// Both re-encodes average the clamped decode in linear light, so the DC
+		// is the linear average of the original decode.
+		var sum [3]float64
+		for i := 0; i < len(orig.Pix); i += 4 {
+			for c := range sum {
+				sum[c] += Linearize(orig.Pix[i+c])
+			}
+		}
+		n := float64(len(orig.Pix) / 4)
+		want := color.RGBA{R: Delinearize(sum[0] / n), G: Delinearize(sum[1] / n), B: Delinearize(sum[2] / n), A: 0xff}
+		if got, _ := DecodeAverageColor(joined); absInt(int(got.R)-int(want.R)) > 2 || absInt(int(got.G)-int(want.G)) > 2 || absInt(int(got.B)-int(want.B)) > 2 {
+			t.Errorf("ConcatHorizontal(SplitHorizontal(%q)) average color %v, want close to %v", hash, got, want)
+		}
+	}
+	if _, _, err := SplitHorizontal("invalid"); err == nil {
+		t.Error("SplitHorizontal of an invalid hash succeeded, want error")
+	}
+}
+
+// meanColor returns the average of the 8-bit R, G and B values of img.
+func meanColor(img image.Image) [3]float64 {
+	bounds := img.Bounds()
+	var m [3]float64
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, _ := img.At(x, y).RGBA()
+			m[0] += float64(r >> 8)
+			m[1] += float64(g >> 8)
+			m[2] += float64(b >> 8)
+		}
+	}
+	n := float64(bounds.Dx() * bounds.Dy())
+	return [3]float64{m[0] / n, m[1] / n, m[2] / n}
+}
+
+// translate returns img moved so that its bounds start at the origin.
+func translate(img image.Image) image.Image {
+	b := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Rect, img, b.Min, draw.Src)
+	return dst
+}
@@ -0,0 +1,682 @@
+// Copyright 2021-2022 Nao Yonashiro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blurhash
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+)
+
+var (
+	// ErrInvalidHash is returned when a hash is not a well-formed blurhash.
+	ErrInvalidHash = errors.New("blurhash: invalid hash")
+	// ErrInvalidPunch is returned when a punch is not positive.
+	ErrInvalidPunch = errors.New("blurhash: punch must be positive")
+)
+
+// Components returns the number of horizontal and vertical components of hash.
+func Components(hash string) (x, y int, err error) {
+	packedShape, err := readBase83(hash, 0, 1)
+	if err != nil {
+		return 0, 0, err
+	}
+	x, y = UnpackShape(packedShape)
+	if !validComponents(x, y) {
+		return 0, 0, fmt.Errorf("%w: size flag %d out of range", ErrInvalidHash, packedShape)
+	}
+	want := 4 + 2*x*y
+	if len(hash) < want {
+		return 0, 0, truncatedError(len(hash))
+	}
+	if len(hash) > want {
+		return 0, 0, fmt.Errorf("%w: length %d, want %d for %dx%d components", ErrInvalidHash, len(hash), want, x, y)
+	}
+	return x, y, nil
+}
+
+// Decode reconstructs the image represented by hash with the given size.
+// The decoded image is fully opaque.
+func Decode(hash string, width, height int, opts ...DecodeOption) (*image.RGBA, error) {
+	cfg, err := newDecodeConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := cfg.parse(hash)
+	if err != nil {
+		return nil, err
+	}
+	return parsed.Decode(width, height, opts...)
+}
+
+// Decode reconstructs the image with the given size.
+// A Parsed hash can be decoded any number of times, at different sizes.
+func (parsed *Parsed) Decode(width, height int, opts ...DecodeOption) (*image.RGBA, error) {
+	cfg, err := newDecodeConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.checkSize(width, height); err != nil {
+		return nil, err
+	}
+	parsed = parsed.punch(cfg.punch)
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	parsed.render(width, height, func(x, y int, c factor) {
+		cfg.store(img.Pix[img.PixOffset(x, y):], x, y, c)
+	})
+	return img, nil
+}
+
+// DecodeDraw decodes hash into dst, using the size of dst.Bounds().
+// It works with any draw.Image but is slower than Decode.
+func DecodeDraw(dst draw.Image, hash string, opts ...DecodeOption) error {
+	bounds := dst.Bounds()
+	return DecodeFunc(hash, bounds.Dx(), bounds.Dy(), func(y int, row []byte) {
+		for x := 0; x < bounds.Dx(); x++ {
+			p := row[x*4 : x*4+4 : x*4+4]
+			dst.Set(bounds.Min.X+x, bounds.Min.Y+y, color.RGBA{R: p[0], G: p[1], B: p[2], A: p[3]})
+		}
+	}, opts...)
+}
+
+// DecodeFunc decodes hash with the given size row by row, calling fn with each row
+// as RGBA bytes. The row buffer is reused and is only valid during the call.
+func DecodeFunc(hash string, width, height int, fn func(y int, row []byte), opts ...DecodeOption) error {
+	cfg, err := newDecodeConfig(opts)
+	if err != nil {
+		return err
+	}
+	if err := cfg.checkSize(width, height); err != nil {
+		return err
+	}
+	parsed, err := cfg.parse(hash)
+	if err != nil {
+		return err
+	}
+	parsed = parsed.punch(cfg.punch)
+
+	row := make([]byte, width*4)
+	parsed.render(width, height, func(x, y int, c factor) {
+		cfg.store(row[x*4:], x, y, c)
+		if x == width-1 {
+			fn(y, row)
+		}
+	})
+	return nil
+}
+
+func (cfg *decodeConfig) remap(c factor) factor {
+	scale := cfg.rangeMax - cfg.rangeMin
+	return factor{
+		r: cfg.rangeMin + clamp(0, 1, c.r)*scale,
+		g: cfg.rangeMin + clamp(0, 1, c.g)*scale,
+		b: cfg.rangeMin + clamp(0, 1, c.b)*scale,
+	}
+}
+
+// applyRange remaps c as set by WithRange.
+func (cfg *decodeConfig) applyRange(c factor) factor {
+	if cfg.rangeMin != 0 || cfg.rangeMax != 1 {
+		return cfg.remap(c)
+	}
+	return c
+}
+
+// store writes the 8-bit RGBA value of the pixel at (x, y) to p.
+func (cfg *decodeConfig) store(p []byte, x, y int, c factor) {
+	c = cfg.applyRange(c)
+	if cfg.dither {
+		t := bayer4x4[y&3][x&3]
+		p[0] = linear(c.r).sRGBDither(t)
+		p[1] = linear(c.g).sRGBDither(t)
+		p[2] = linear(c.b).sRGBDither(t)
+	} else {
+		p[0] = linear(c.r).sRGB()
+		p[1] = linear(c.g).sRGB()
+		p[2] = linear(c.b).sRGB()
+	}
+	p[3] = 0xff
+}
+
+// fill sets every pixel of img to c as store would. Dithering repeats every
+// 4 pixels, so only a tile of 4x4 pixels is converted.
+func (cfg *decodeConfig) fill(img *image.RGBA, c factor) {
+	var tile [4][4][4]byte
+	for y := range tile {
+		for x := range tile[y] {
+			cfg.store(tile[y][x][:], x, y, c)
+		}
+	}
+	for y := 0; y < img.Rect.Dy(); y++ {
+		row := img.Pix[y*img.Stride:]
+		for x := 0; x < img.Rect.Dx(); x++ {
+			copy(row[x*4:x*4+4], tile[y&3][x&3][:])
+		}
+	}
+}
+
+// DecodeRegion decodes only the pixels within crop of the image that Decode would
+// produce for hash with the size of full. The returned image has the bounds
+// crop.Intersect(full), in the coordinate space of full.
+func DecodeRegion(hash string, full image.Rectangle, crop image.Rectangle, opts ...DecodeOption) (*image.RGBA, error) {
+	if full.Empty() {
+		return nil, fmt.Errorf("blurhash: invalid size %dx%d", full.Dx(), full.Dy())
+	}
+	crop = crop.Intersect(full)
+	if crop.Empty() {
+		return nil, fmt.Errorf("blurhash: crop %v does not overlap %v", crop, full)
+	}
+	cfg, err := newDecodeConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.checkSize(crop.Dx(), crop.Dy()); err != nil {
+		return nil, err
+	}
+	parsed, err := cfg.parse(hash)
+	if err != nil {
+		return nil, err
+	}
+	parsed = parsed.punch(cfg.punch)
+
+	img := image.NewRGBA(crop)
+	parsed.renderRect(full.Dx(), full.Dy(), crop.Sub(full.Min), func(x, y int, c factor) {
+		// Dithering uses the coordinates of the full decode, as Decode would.
+		cfg.store(img.Pix[img.PixOffset(x+full.Min.X, y+full.Min.Y):], x, y, c)
+	})
+	return img, nil
+}
+
+// DecodeRGBA64 is like Decode but produces 16 bits per channel.
+// WithDither has no effect, as 16 bits per channel do not band visibly.
+func DecodeRGBA64(hash string, width, height int, opts ...DecodeOption) (*image.RGBA64, error) {
+	cfg, err := newDecodeConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.checkSize(width, height); err != nil {
+		return nil, err
+	}
+	parsed, err := cfg.parse(hash)
+	if err != nil {
+		return nil, err
+	}
+	parsed = parsed.punch(cfg.punch)
+
+	img := image.NewRGBA64(image.Rect(0, 0, width, height))
+	parsed.render(width, height, func(x, y int, c factor) {
+		c = cfg.applyRange(c)
+		img.SetRGBA64(x, y, color.RGBA64{
+			R: linear(c.r).sRGB16(),
+			G: linear(c.g).sRGB16(),
+			B: linear(c.b).sRGB16(),
+			A: 0xffff,
+		})
+	})
+	return img, nil
+}
+
+// DecodeLinearPix is like Decode but returns the reconstructed linear RGB values
+// without converting them to sRGB. The pixel at (x, y) is at pix[(y*width+x)*3:][:3]
+// in R, G, B order, so len(pix) == width*height*3. Values are not clamped and may
+// fall slightly outside range 0..1, unless WithRange is given, which clamps them
+// before remapping as for the other decoders. WithDither has no effect.
+func DecodeLinearPix(hash string, width, height int, opts ...DecodeOption) ([]float64, error) {
+	cfg, err := newDecodeConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.checkSize(width, height); err != nil {
+		return nil, err
+	}
+	parsed, err := cfg.parse(hash)
+	if err != nil {
+		return nil, err
+	}
+	parsed = parsed.punch(cfg.punch)
+
+	pix := make([]float64, width*height*3)
+	parsed.render(width, height, func(x, y int, c factor) {
+		c = cfg.applyRange(c)
+		p := pix[(y*width+x)*3:]
+		p[0], p[1], p[2] = c.r, c.g, c.b
+	})
+	return pix, nil
+}
+
+// DecodePaletted is like Decode but maps every pixel to the nearest color of palette,
+// as chosen by WithNearest, producing an indexed image that is a quarter of the size of the RGBA one.
+// The palette must have 1 to 256 colors, as indices are stored in one byte.
+func DecodePaletted(hash string, width, height int, palette color.Palette, opts ...DecodeOption) (*image.Paletted, error) {
+	if len(palette) == 0 {
+		return nil, fmt.Errorf("blurhash: empty palette")
+	}
+	if len(palette) > 256 {
+		return nil, fmt.Errorf("blurhash: palette has %d colors, more than 256", len(palette))
+	}
+	cfg, err := newDecodeConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.checkSize(width, height); err != nil {
+		return nil, err
+	}
+	parsed, err := cfg.parse(hash)
+	if err != nil {
+		return nil, err
+	}
+	parsed = parsed.punch(cfg.punch)
+
+	img := image.NewPaletted(image.Rect(0, 0, width, height), palette)
+	var p [4]byte
+	parsed.render(width, height, func(x, y int, c factor) {
+		cfg.store(p[:], x, y, c)
+		img.Pix[img.PixOffset(x, y)] = uint8(cfg.nearest(palette, color.RGBA{R: p[0], G: p[1], B: p[2], A: p[3]}))
+	})
+	return img, nil
+}
+
+// DecodeAverageColor returns the average color of the image represented by hash.
+// It checks the header and length of hash but does not read the AC digits;
+// use Validate to check them too.
+func DecodeAverageColor(hash string) (color.RGBA, error) {
+	if _, _, err := Components(hash); err != nil {
+		return color.RGBA{}, err
+	}
+	dc, err := readBase83(hash, 2, 4)
+	if err != nil {
+		return color.RGBA{}, err
+	}
+	return color.RGBA{R: uint8(dc >> 16), G: uint8(dc >> 8), B: uint8(dc), A: 0xff}, nil
+}
+
+// DecodeMean returns the DC color of hash, the cheapest placeholder it can render.
+// It reads only the header and the DC digits, evaluates no basis functions and
+// does not allocate for a valid hash. It is equivalent to DecodeAverageColor.
+func DecodeMean(hash string) (color.RGBA, error) {
+	return DecodeAverageColor(hash)
+}
+
+// AverageColorLinearNormalized returns the average color of hash as linear RGB
+// values in range 0..1. Blurhash averages pixels in linear light, whereas
+// ThumbHash averages the gamma-encoded values, so for the same image the DC of a
+// ThumbHash is closer to the sRGB encoding of these values than to the values themselves.
+func AverageColorLinearNormalized(hash string) (r, g, b float64, err error) {
+	c, err := DecodeAverageColor(hash)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	return sRGB(c.R).linear(), sRGB(c.G).linear(), sRGB(c.B).linear(), nil
+}
+
+// Swatch returns a size x size image filled with the average color of hash.
+// WithRange and WithDither apply as they do to Decode; WithPunch has no effect,
+// as it only scales the AC components.
+func Swatch(hash string, size int, opts ...DecodeOption) (*image.RGBA, error) {
+	cfg, err := newDecodeConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.checkSize(size, size); err != nil {
+		return nil, err
+	}
+	c, err := DecodeAverageColor(cfg.normalize(hash))
+	if err != nil {
+		return nil, err
+	}
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	cfg.fill(img, factor{r: sRGB(c.R).linear(), g: sRGB(c.G).linear(), b: sRGB(c.B).linear()})
+	return img, nil
+}
+
+// DecodeComponents returns the dequantised linear coefficients of hash as
+// separate red, green and blue planes in row-major order, numX per row.
+func DecodeComponents(hash string) (r, g, b []float64, numX, numY int, err error) {
+	parsed, err := Parse(hash)
+	if err != nil {
+		return nil, nil, nil, 0, 0, err
+	}
+	n := len(parsed.factors)
+	r = make([]float64, n)
+	g = make([]float64, n)
+	b = make([]float64, n)
+	for i, f := range parsed.factors {
+		r[i], g[i], b[i] = f.r, f.g, f.b
+	}
+	return r, g, b, parsed.numX, parsed.numY, nil
+}
+
+// DefaultMaxOutputPixels is the largest number of pixels a decoder produces
+// unless WithMaxOutputPixels is given.
+const DefaultMaxOutputPixels = 1 << 26
+
+func checkSize(width, height int) error {
+	return checkSizeLimit(width, height, DefaultMaxOutputPixels)
+}
+
+func (cfg *decodeConfig) checkSize(width, height int) error {
+	return checkSizeLimit(width, height, cfg.maxPixels)
+}
+
+func checkSizeLimit(width, height int, maxPixels int64) error {
+	if width <= 0 || height <= 0 {
+		return fmt.Errorf("blurhash: invalid size %dx%d", width, height)
+	}
+	if int64(width)*int64(height) > maxPixels {
+		return fmt.Errorf("blurhash: size %dx%d exceeds the limit of %d pixels", width, height, maxPixels)
+	}
+	return nil
+}
+
+// renderCos is like renderRect but looks the basis up in tables holding
+// cos(π·x·i/width) at xCos[(x-r.Min.X)*9+i], and likewise for y.
+func (parsed *Parsed) renderCos(xCos, yCos []float64, r image.Rectangle, fn func(x, y int, c factor)) {
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		yc := yCos[(y-r.Min.Y)*9:]
+		for x := r.Min.X; x < r.Max.X; x++ {
+			xc := xCos[(x-r.Min.X)*9:]
+			var c factor
+			for j := 0; j < parsed.numY; j++ {
+				for i := 0; i < parsed.numX; i++ {
+					basis := xc[i] * yc[j]
+					f := parsed.factors[j*parsed.numX+i]
+					c.r += f.r * basis
+					c.g += f.g * basis
+					c.b += f.b * basis
+				}
+			}
+			fn(x, y, c)
+		}
+	}
+}
+
+// punch returns parsed with the AC components scaled by punch.
+func (parsed *Parsed) punch(punch float64) *Parsed {
+	if punch == 1 {
+		return parsed
+	}
+	punched := *parsed
+	punched.factors = make([]factor, len(parsed.factors))
+	copy(punched.factors, parsed.factors)
+	for i := 1; i < len(punched.factors); i++ {
+		punched.factors[i].Scale(punch)
+	}
+	return &punched
+}
+
+// render evaluates the reconstructed linear color of every pixel of a width x height image.
+func (parsed *Parsed) render(width, height int, fn func(x, y int, c factor)) {
+	parsed.renderRect(width, height, image.Rect(0, 0, width, height), fn)
+}
+
+// renderRect is like render but only evaluates the pixels within r.
+func (parsed *Parsed) renderRect(width, height int, r image.Rectangle, fn func(x, y int, c factor)) {
+	var xCos, yCos []float64
+	if r.Min.X == 0 && r.Max.X == width {
+		xCos = buildCosTable(nil, width)
+	} else {
+		xCos = buildCosTableRange(width, r.Min.X, r.Max.X)
+	}
+	if r.Min.Y == 0 && r.Max.Y == height {
+		yCos = buildCosTable(nil, height)
+	} else {
+		yCos = buildCosTableRange(height, r.Min.Y, r.Max.Y)
+	}
+	parsed.renderCos(xCos, yCos, r, fn)
+}
+
+// bayer4x4 holds ordered dithering thresholds in range (0, 1).
+var bayer4x4 = [4][4]float64{
+	{0.5 / 16, 8.5 / 16, 2.5 / 16, 10.5 / 16},
+	{12.5 / 16, 4.5 / 16, 14.5 / 16, 6.5 / 16},
+	{3.5 / 16, 11.5 / 16, 1.5 / 16, 9.5 / 16},
+	{15.5 / 16, 7.5 / 16, 13.5 / 16, 5.5 / 16},
+}
+
+// DecodeAuto decodes hash with the long edge of the output set to longEdge
+// and the short edge derived from the aspect ratio of the component grid.
+// It returns an error if longEdge is not positive.
+func DecodeAuto(hash string, longEdge int) (*image.RGBA, error) {
+	if longEdge <= 0 {
+		return nil, fmt.Errorf("blurhash: invalid long edge %d", longEdge)
+	}
+	numX, numY, err := Components(hash)
+	if err != nil {
+		return nil, err
+	}
+	width, height := longEdge, longEdge
+	if numX > numY {
+		height = int(math.Round(float64(longEdge*numY) / float64(numX)))
+	} else if numY > numX {
+		width = int(math.Round(float64(longEdge*numX) / float64(numY)))
+	}
+	if width < 1 {
+		width = 1
+	}
+	if height < 1 {
+		height = 1
+	}
+	return Decode(hash, width, height)
+}
+
+// canonicalSize is the size per axis at which Canonicalize decodes a hash.
+const canonicalSize = 32
+
+// Canonicalize decodes hash at a fixed internal size and encodes the result
+// again with the same component grid, so that hashes from other encoders are
+// quantised the way this package quantises them. This may change the last bits
+// of any digit, including the maximum AC value.
+//
+// It is meant for deduplication, but only as a heuristic: hashes that differ by
+// one quantisation level in a component sometimes canonicalize to the same
+// string, and otherwise stay distinct. Of the single-level changes to a few
+// sample hashes, fewer than one in ten merged with the original. Canonicalize is
+// not idempotent either, as the round trip through pixels drifts, so hashes must
+// each be canonicalized exactly once before comparing them.
+func Canonicalize(hash string) (string, error) {
+	parsed, err := Parse(hash)
+	if err != nil {
+		return "", err
+	}
+	img, err := parsed.Decode(canonicalSize, canonicalSize)
+	if err != nil {
+		return "", err
+	}
+	return Encode(img, parsed.numX, parsed.numY), nil
+}
+
+// FitMode selects how DecodeFit maps the aspect ratio of the component grid
+// onto the output rectangle.
+type FitMode int
+
+const (
+	// FitStretch decodes to the whole output, ignoring the aspect ratio.
+	FitStretch FitMode = iota
+	// FitContain decodes to the largest centered rectangle with the aspect ratio
+	// that fits within the output, letterboxed with the average color of the hash,
+	// to which WithRange and WithDither apply as to the content.
+	FitContain
+	// FitCover decodes to the smallest rectangle with the aspect ratio that covers
+	// the output, keeping its centered part.
+	FitCover
+)
+
+// DecodeFit decodes hash to a width x height image, using the aspect ratio of its
+// component grid as the aspect ratio of the image, as DecodeAuto does.
+func DecodeFit(hash string, width, height int, mode FitMode, opts ...DecodeOption) (*image.RGBA, error) {
+	cfg, err := newDecodeConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.checkSize(width, height); err != nil {
+		return nil, err
+	}
+	hash = cfg.normalize(hash)
+	parsed, err := Parse(hash)
+	if err != nil {
+		return nil, err
+	}
+	numX, numY := parsed.numX, parsed.numY
+	contentW := width
+	contentH := int(math.Round(float64(width*numY) / float64(numX)))
+	switch mode {
+	case FitStretch:
+		return Decode(hash, width, height, opts...)
+	case FitContain:
+		if contentH > height {
+			contentW, contentH = int(math.Round(float64(height*numX)/float64(numY))), height
+		}
+	case FitCover:
+		if contentH < height {
+			contentW, contentH = int(math.Round(float64(height*numX)/float64(numY))), height
+		}
+	default:
+		return nil, fmt.Errorf("blurhash: unknown fit mode %d", mode)
+	}
+	if contentW < 1 {
+		contentW = 1
+	}
+	if contentH < 1 {
+		contentH = 1
+	}
+	offX, offY := (contentW-width)/2, (contentH-height)/2
+	content := image.Rect(-offX, -offY, contentW-offX, contentH-offY)
+	if mode == FitCover {
+		return DecodeRegion(hash, content, image.Rect(0, 0, width, height), opts...)
+	}
+
+	src, err := Decode(hash, contentW, contentH, opts...)
+	if err != nil {
+		return nil, err
+	}
+	// The letterbox is the DC color, stored like the content so that WithRange
+	// and WithDither apply to it too. WithPunch only scales the AC components.
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	cfg.fill(img, parsed.factors[0])
+	draw.Draw(img, content, src, image.Point{}, draw.Src)
+	return img, nil
+}
+
+// Parsed is a parsed blurhash. It separates the cost of parsing a hash
+// from the cost of rendering it.
+type Parsed struct {
+	numX, numY int
+	max        float64
+	factors    []factor
+}
+
+// Validate returns an error if hash is not a well-formed blurhash, without decoding it.
+// No input makes it, or any other function of the package taking a hash, panic.
+func Validate(hash string) error {
+	if _, _, err := Components(hash); err != nil {
+		return err
+	}
+	for i := 1; i < len(hash); i++ {
+		if _, err := readBase83(hash, i, 1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Parse parses hash.
+func Parse(hash string) (*Parsed, error) {
+	numX, numY, err := Components(hash)
+	if err != nil {
+		return nil, err
+	}
+	quantisedMax, err := readBase83(hash, 1, 1)
+	if err != nil {
+		return nil, err
+	}
+	parsed := &Parsed{
+		numX:    numX,
+		numY:    numY,
+		max:     float64(quantisedMax+1) / 166,
+		factors: make([]factor, numX*numY),
+	}
+	dc, err := readBase83(hash, 2, 4)
+	if err != nil {
+		return nil, err
+	}
+	parsed.factors[0] = decodeDC(dc)
+	for i := 1; i < len(parsed.factors); i++ {
+		ac, err := readBase83(hash, 4+i*2, 2)
+		if err != nil {
+			return nil, err
+		}
+		parsed.factors[i] = decodeAC(ac, parsed.max)
+	}
+	return parsed, nil
+}
+
+func decodeDC(v int) factor {
+	return factor{
+		r: sRGB(v >> 16).linear(),
+		g: sRGB(v >> 8).linear(),
+		b: sRGB(v).linear(),
+	}
+}
+
+func decodeAC(v int, max float64) factor {
+	quantR := v / (19 * 19)
+	quantG := (v / 19) % 19
+	quantB := v % 19
+	return factor{
+		r: signPow2(float64(quantR-9)/9) * max,
+		g: signPow2(float64(quantG-9)/9) * max,
+		b: signPow2(float64(quantB-9)/9) * max,
+	}
+}
+
+func signPow2(value float64) float64 {
+	return math.Copysign(value*value, value)
+}
+
+// readBase83 decodes the n digits of hash starting at offset.
+func readBase83(hash string, offset, n int) (int, error) {
+	if len(hash) < offset+n {
+		return 0, truncatedError(len(hash))
+	}
+	v := 0
+	for i := offset; i < offset+n; i++ {
+		d := base83Table[hash[i]]
+		if d < 0 {
+			return 0, fmt.Errorf("%w: invalid base83 character %q at offset %d", ErrInvalidHash, hash[i], i)
+		}
+		v = v*83 + int(d)
+	}
+	return v, nil
+}
+
+// truncatedError describes a hash that ends after n characters.
+func truncatedError(n int) error {
+	var field string
+	switch {
+	case n < 1:
+		field = "the size flag"
+	case n < 2:
+		field = "the maximum AC value"
+	case n < 6:
+		field = "the DC component"
+	default:
+		field = fmt.Sprintf("AC component %d", (n-6)/2+1)
+	}
+	return fmt.Errorf("%w: truncated at offset %d in %s", ErrInvalidHash, n, field)
+}
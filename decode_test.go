@@ -0,0 +1,1167 @@
+// Copyright 2021-2022 Nao Yonashiro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blurhash
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestDecodeAuto(t *testing.T) {
+	tests := []struct {
+		name          string
+		w, h          int
+		width, height int
+	}{
+		{"square", 3, 3, 300, 300},
+		{"landscape", 6, 4, 300, 200},
+		{"portrait", 4, 6, 200, 300},
+		{"wide", 9, 1, 300, 33},
+		{"tall", 1, 9, 33, 300},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hash := Encode(gradientImage(64, 64), tt.w, tt.h)
+			img, err := DecodeAuto(hash, 300)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := img.Bounds().Size(); got.X != tt.width || got.Y != tt.height {
+				t.Errorf("size = %dx%d, want %dx%d", got.X, got.Y, tt.width, tt.height)
+			}
+		})
+	}
+}
+
+func TestDecodeAutoInvalid(t *testing.T) {
+	hash := Encode(gradientImage(64, 64), 4, 3)
+	for _, longEdge := range []int{0, -1} {
+		if _, err := DecodeAuto(hash, longEdge); err == nil {
+			t.Errorf("DecodeAuto(%q, %d) succeeded, want error", hash, longEdge)
+		}
+	}
+	if _, err := DecodeAuto("invalid", 300); err == nil {
+		t.Error("DecodeAuto of an invalid hash succeeded, want error")
+	}
+}
+
+func TestWithDither(t *testing.T) {
+	hash := Encode(gradientImage(64, 64), 4, 3)
+	plain, err := Decode(hash, 256, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dithered, err := Decode(hash, 256, 256, WithDither(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(plain.Pix, dithered.Pix) {
+		t.Error("WithDither(true) did not change the output")
+	}
+	var sumPlain, sumDithered [3]float64
+	for i := 0; i < len(plain.Pix); i += 4 {
+		for c := 0; c < 3; c++ {
+			sumPlain[c] += float64(plain.Pix[i+c])
+			sumDithered[c] += float64(dithered.Pix[i+c])
+		}
+		if dithered.Pix[i+3] != 0xff {
+			t.Fatalf("alpha at offset %d = %d, want 255", i, dithered.Pix[i+3])
+		}
+	}
+	n := float64(len(plain.Pix) / 4)
+	for c := 0; c < 3; c++ {
+		if d := math.Abs(sumPlain[c]-sumDithered[c]) / n; d > 0.25 {
+			t.Errorf("channel %d: mean differs by %.3f, want at most 0.25", c, d)
+		}
+	}
+
+	off, err := Decode(hash, 256, 256, WithDither(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plain.Pix, off.Pix) {
+		t.Error("WithDither(false) differs from the default")
+	}
+}
+
+func TestDecodeRGBA64(t *testing.T) {
+	for _, hash := range []string{
+		Encode(gradientImage(64, 48), 4, 3),
+		Encode(detailImage(64, 48), 9, 9),
+		"LEHV6nWB2yk8pyo0adR*.7kCMdnj",
+	} {
+		want, err := Decode(hash, 64, 48)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := DecodeRGBA64(hash, 64, 48)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Bounds() != want.Bounds() {
+			t.Fatalf("bounds = %v, want %v", got.Bounds(), want.Bounds())
+		}
+		for i := 0; i < len(want.Pix); i++ {
+			// The 8-bit value is the 16-bit value rounded to the nearest multiple of 257,
+			// which is not always its high byte.
+			v := uint16(got.Pix[i*2])<<8 | uint16(got.Pix[i*2+1])
+			if g := uint8((uint32(v) + 128) / 257); g != want.Pix[i] {
+				t.Fatalf("%s: channel %d of pixel %d = %#04x, want %#02x*257", hash, i%4, i/4, v, want.Pix[i])
+			}
+		}
+	}
+}
+
+func TestDecodeRGBA64Options(t *testing.T) {
+	const hash = "LEHV6nWB2yk8pyo0adR*.7kCMdnj"
+	opts := []DecodeOption{WithPunch(2), WithRange(0.2, 0.5), WithLenientWhitespace(true)}
+	want, err := Decode(hash, 32, 24, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := DecodeRGBA64(" "+hash[:10]+"\n"+hash[10:], 32, 24, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < len(want.Pix); i++ {
+		v := uint16(got.Pix[i*2])<<8 | uint16(got.Pix[i*2+1])
+		if g := uint8((uint32(v) + 128) / 257); g != want.Pix[i] {
+			t.Fatalf("channel %d of pixel %d = %#04x, want %#02x*257 as with Decode", i%4, i/4, v, want.Pix[i])
+		}
+	}
+	if _, err := DecodeRGBA64(hash, 32, 24, WithMaxOutputPixels(32*24-1)); err == nil {
+		t.Error("DecodeRGBA64 above WithMaxOutputPixels succeeded, want error")
+	}
+	if _, err := DecodeRGBA64(hash, 32, 24, WithPunch(0)); !errors.Is(err, ErrInvalidPunch) {
+		t.Errorf("DecodeRGBA64 with WithPunch(0) = %v, want ErrInvalidPunch", err)
+	}
+}
+
+func TestDecodeComponents(t *testing.T) {
+	const width, height = 32, 24
+	hash := Encode(detailImage(64, 48), 5, 4)
+	r, g, b, numX, numY, err := DecodeComponents(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if numX != 5 || numY != 4 || len(r) != 20 || len(g) != 20 || len(b) != 20 {
+		t.Fatalf("DecodeComponents = %d, %d, %d, %d, %d planes, want 5x4 with 20 values", numX, numY, len(r), len(g), len(b))
+	}
+	img, err := Decode(hash, width, height)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var c [3]float64
+			for j := 0; j < numY; j++ {
+				for i := 0; i < numX; i++ {
+					basis := math.Cos(math.Pi*float64(x*i)/width) * math.Cos(math.Pi*float64(y*j)/height)
+					k := j*numX + i
+					c[0] += r[k] * basis
+					c[1] += g[k] * basis
+					c[2] += b[k] * basis
+				}
+			}
+			p := img.Pix[img.PixOffset(x, y):]
+			for ch := 0; ch < 3; ch++ {
+				if d := int(Delinearize(c[ch])) - int(p[ch]); d < -1 || d > 1 {
+					t.Fatalf("pixel (%d, %d) channel %d = %d, want %d", x, y, ch, Delinearize(c[ch]), p[ch])
+				}
+			}
+		}
+	}
+	if _, _, _, _, _, err := DecodeComponents("invalid"); err == nil {
+		t.Error("DecodeComponents of an invalid hash succeeded, want error")
+	}
+}
+
+func TestParsedDecode(t *testing.T) {
+	hash := Encode(detailImage(64, 48), 4, 3)
+	parsed, err := Parse(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range [][2]int{{32, 32}, {64, 48}, {7, 100}} {
+		want, err := Decode(hash, size[0], size[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := parsed.Decode(size[0], size[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Rect != want.Rect || !bytes.Equal(got.Pix, want.Pix) {
+			t.Errorf("%dx%d: Parsed.Decode differs from Decode", size[0], size[1])
+		}
+	}
+	if _, err := parsed.Decode(0, 10); err == nil {
+		t.Error("Parsed.Decode(0, 10) succeeded, want error")
+	}
+	if _, err := Parse("invalid"); err == nil {
+		t.Error("Parse of an invalid hash succeeded, want error")
+	}
+}
+
+func TestWithPunchInvalid(t *testing.T) {
+	hash := Encode(detailImage(64, 48), 4, 3)
+	decoders := map[string]func(opt DecodeOption) error{
+		"Decode": func(opt DecodeOption) error {
+			_, err := Decode(hash, 8, 8, opt)
+			return err
+		},
+		"DecodeFunc": func(opt DecodeOption) error {
+			return DecodeFunc(hash, 8, 8, func(int, []byte) {}, opt)
+		},
+		"DecodeRegion": func(opt DecodeOption) error {
+			_, err := DecodeRegion(hash, image.Rect(0, 0, 8, 8), image.Rect(2, 2, 4, 4), opt)
+			return err
+		},
+		"Decoder.Decode": func(opt DecodeOption) error {
+			_, err := NewDecoder(8, 8).Decode(hash, opt)
+			return err
+		},
+	}
+	for name, decode := range decoders {
+		for _, punch := range []float64{0, -1, math.NaN()} {
+			if err := decode(WithPunch(punch)); !errors.Is(err, ErrInvalidPunch) {
+				t.Errorf("%s with WithPunch(%v): error = %v, want ErrInvalidPunch", name, punch, err)
+			}
+		}
+		if err := decode(WithPunch(2)); err != nil {
+			t.Errorf("%s with WithPunch(2): %v", name, err)
+		}
+	}
+}
+
+func TestWithPunch(t *testing.T) {
+	hash := Encode(gradientImage(64, 48), 4, 3)
+	plain, err := Decode(hash, 32, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	punched, err := Decode(hash, 32, 32, WithPunch(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A punch above 1 increases the contrast: the red channel, which varies
+	// across the image, spans a wider range.
+	span := func(img *image.RGBA) int {
+		lo, hi := 255, 0
+		for i := 0; i < len(img.Pix); i += 4 {
+			lo, hi = minInt(lo, int(img.Pix[i])), maxInt(hi, int(img.Pix[i]))
+		}
+		return hi - lo
+	}
+	if span(punched) <= span(plain) {
+		t.Errorf("red span with WithPunch(2) = %d, want more than %d", span(punched), span(plain))
+	}
+}
+
+func TestPunchViaMax(t *testing.T) {
+	// AC digits are quantised relative to the maximum, so scaling every AC term
+	// by the punch only scales the stored maximum (q+1)/166. With a punch of 2 it
+	// is exactly representable as 2q+1 while that fits in a digit, and both
+	// methods reconstruct the same image.
+	for _, name := range []string{"photo.png", "gray.png"} {
+		hash := Encode(readPNG(t, name), 4, 3)
+		q, err := readBase83(hash, 1, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if 2*q+1 > 82 {
+			t.Fatalf("%s: quantised max %d saturates with a punch of 2", name, q)
+		}
+		baked := hash[:1] + Base83Alphabet[2*q+1:2*q+2] + hash[2:]
+		want, err := Decode(hash, 32, 24, WithPunch(2))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := Decode(baked, 32, 24)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e := rmse(got, want); e != 0 {
+			t.Errorf("%s: %q decodes %v RMSE away from %q with WithPunch(2), want identical", name, baked, e, hash)
+		}
+	}
+}
+
+func TestDecodeFuncReusesRow(t *testing.T) {
+	hash := Encode(detailImage(64, 48), 4, 3)
+	want, err := Decode(hash, 40, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var first *byte
+	rows := 0
+	err = DecodeFunc(hash, 40, 30, func(y int, row []byte) {
+		if first == nil {
+			first = &row[0]
+		} else if &row[0] != first {
+			t.Fatalf("row %d uses a different buffer", y)
+		}
+		if y != rows {
+			t.Fatalf("got row %d, want %d", y, rows)
+		}
+		rows++
+		if !bytes.Equal(row, want.Pix[want.PixOffset(0, y):want.PixOffset(0, y+1)]) {
+			t.Errorf("row %d differs from Decode", y)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows != 30 {
+		t.Errorf("got %d rows, want 30", rows)
+	}
+}
+
+func TestDecodeFuncAllocs(t *testing.T) {
+	hash := Encode(detailImage(64, 48), 4, 3)
+	allocs := func(width, height int) float64 {
+		return testing.AllocsPerRun(3, func() {
+			DecodeFunc(hash, width, height, func(int, []byte) {})
+		})
+	}
+	small := allocs(16, 16)
+	for _, size := range [][2]int{{1920, 16}, {16, 1080}} {
+		if n := allocs(size[0], size[1]); n != small {
+			t.Errorf("DecodeFunc makes %v allocations at %dx%d and %v at 16x16, want the same", n, size[0], size[1], small)
+		}
+	}
+}
+
+func BenchmarkDecodeFunc1080p(b *testing.B) {
+	hash := Encode(detailImage(64, 48), 4, 3)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		DecodeFunc(hash, 1920, 1080, func(int, []byte) {})
+	}
+}
+
+func TestDecodeMatchesDirect(t *testing.T) {
+	hashes := []string{
+		"LEHV6nWB2yk8pyo0adR*.7kCMdnj",
+		Encode(detailImage(64, 48), 8, 8),
+		Encode(detailImage(64, 48), 9, 9),
+	}
+	for _, hash := range hashes {
+		parsed, err := Parse(hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, size := range [][2]int{{1, 1}, {7, 5}, {64, 48}, {201, 33}} {
+			width, height := size[0], size[1]
+			img, err := Decode(hash, width, height)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for y := 0; y < height; y++ {
+				for x := 0; x < width; x++ {
+					var c factor
+					for j := 0; j < parsed.numY; j++ {
+						for i := 0; i < parsed.numX; i++ {
+							basis := math.Cos(math.Pi*float64(x*i)/float64(width)) * math.Cos(math.Pi*float64(y*j)/float64(height))
+							f := parsed.factors[j*parsed.numX+i]
+							c.r += f.r * basis
+							c.g += f.g * basis
+							c.b += f.b * basis
+						}
+					}
+					got := img.RGBAAt(x, y)
+					want := color.RGBA{R: Delinearize(c.r), G: Delinearize(c.g), B: Delinearize(c.b), A: 0xff}
+					if absInt(int(got.R)-int(want.R)) > 1 || absInt(int(got.G)-int(want.G)) > 1 || absInt(int(got.B)-int(want.B)) > 1 {
+						t.Fatalf("%q at %dx%d: pixel (%d, %d) = %v, want %v", hash, width, height, x, y, got, want)
+					}
+				}
+			}
+		}
+	}
+}
+
+func BenchmarkDecode640x480(b *testing.B) {
+	hash := Encode(detailImage(64, 48), 8, 8)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		Decode(hash, 640, 480)
+	}
+}
+
+func TestDecodeAllocs(t *testing.T) {
+	hash := Encode(detailImage(64, 48), 4, 3)
+	allocs := func(width, height int) float64 {
+		return testing.AllocsPerRun(10, func() {
+			Decode(hash, width, height)
+		})
+	}
+	// Pixels are written straight into Pix, so only the image, the parsed hash
+	// and the cosine tables are allocated, whatever the size.
+	small := allocs(16, 16)
+	for _, size := range [][2]int{{640, 16}, {16, 480}, {256, 256}} {
+		if n := allocs(size[0], size[1]); n != small {
+			t.Errorf("Decode makes %v allocations at %dx%d and %v at 16x16, want the same", n, size[0], size[1], small)
+		}
+	}
+}
+
+// decodeNaive is Decode written with image.RGBA.Set, which converts every
+// pixel through the color.Color interface, as a baseline for BenchmarkDecodeSet.
+func decodeNaive(hash string, width, height int) *image.RGBA {
+	parsed, err := Parse(hash)
+	if err != nil {
+		panic(err)
+	}
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	parsed.render(width, height, func(x, y int, c factor) {
+		img.Set(x, y, color.RGBA{R: linear(c.r).sRGB(), G: linear(c.g).sRGB(), B: linear(c.b).sRGB(), A: 0xff})
+	})
+	return img
+}
+
+func BenchmarkDecodeSet(b *testing.B) {
+	hash := Encode(detailImage(64, 48), 4, 3)
+	want, err := Decode(hash, 32, 32)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if !bytes.Equal(decodeNaive(hash, 32, 32).Pix, want.Pix) {
+		b.Fatal("decodeNaive differs from Decode")
+	}
+	for _, size := range []int{64, 512} {
+		b.Run(fmt.Sprintf("Pix/%d", size), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				Decode(hash, size, size)
+			}
+		})
+		b.Run(fmt.Sprintf("Set/%d", size), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				decodeNaive(hash, size, size)
+			}
+		})
+	}
+}
+
+func TestCanonicalize(t *testing.T) {
+	// The two hashes differ by one level in the red channel of the first AC component.
+	a, b := "LEHV6nWB2yk8pyo0adR*.7kCMdnj", "LEHV6nWC2yk8pyo0adR*.7kCMdnj"
+	ca, err := Canonicalize(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cb, err := Canonicalize(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ca != cb {
+		t.Errorf("Canonicalize(%q) = %q, Canonicalize(%q) = %q, want the same", a, ca, b, cb)
+	}
+	if err := Validate(ca); err != nil {
+		t.Errorf("Canonicalize(%q) = %q: %v", a, ca, err)
+	}
+	if x, y, _ := Components(ca); x != 4 || y != 3 {
+		t.Errorf("Canonicalize(%q) has %dx%d components, want 4x3", a, x, y)
+	}
+	if _, err := Canonicalize("invalid"); err == nil {
+		t.Error("Canonicalize of an invalid hash succeeded, want error")
+	}
+}
+
+func TestDecodeFit(t *testing.T) {
+	hash := "LEHV6nWB2yk8pyo0adR*.7kCMdnj" // 4x3 components
+	avg, err := DecodeAverageColor(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name          string
+		mode          FitMode
+		width, height int
+		// content is where the decoded image of size contentW x contentH is placed.
+		content            image.Rectangle
+		contentW, contentH int
+	}{
+		{"stretch", FitStretch, 100, 50, image.Rect(0, 0, 100, 50), 100, 50},
+		{"contain wide", FitContain, 100, 50, image.Rect(16, 0, 83, 50), 67, 50},
+		{"contain tall", FitContain, 50, 100, image.Rect(0, 31, 50, 69), 50, 38},
+		{"cover wide", FitCover, 100, 50, image.Rect(0, -12, 100, 63), 100, 75},
+		{"cover tall", FitCover, 50, 100, image.Rect(-41, 0, 92, 100), 133, 100},
+	}
+	for _, tt := range tests {
+		img, err := DecodeFit(hash, tt.width, tt.height, tt.mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := img.Bounds(), image.Rect(0, 0, tt.width, tt.height); got != want {
+			t.Fatalf("%s: bounds %v, want %v", tt.name, got, want)
+		}
+		content, err := Decode(hash, tt.contentW, tt.contentH)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for y := 0; y < tt.height; y++ {
+			for x := 0; x < tt.width; x++ {
+				got := img.RGBAAt(x, y)
+				want := avg
+				if p := image.Pt(x, y); p.In(tt.content) {
+					want = content.RGBAAt(x-tt.content.Min.X, y-tt.content.Min.Y)
+				}
+				if absInt(int(got.R)-int(want.R)) > 1 || absInt(int(got.G)-int(want.G)) > 1 || absInt(int(got.B)-int(want.B)) > 1 || got.A != want.A {
+					t.Fatalf("%s: pixel (%d, %d) = %v, want %v", tt.name, x, y, got, want)
+				}
+			}
+		}
+	}
+	if _, err := DecodeFit(hash, 100, 50, FitMode(-1)); err == nil {
+		t.Error("DecodeFit with an unknown mode succeeded, want error")
+	}
+}
+
+func TestDecodeFitOptions(t *testing.T) {
+	hash := "LEHV6nWB2yk8pyo0adR*.7kCMdnj" // 4x3 components
+	// The size is checked against WithMaxOutputPixels, like Decode does.
+	if _, err := DecodeFit(hash, 20, 20, FitContain, WithMaxOutputPixels(100)); err == nil {
+		t.Error("DecodeFit above a lowered limit succeeded, want error")
+	}
+	const width = DefaultMaxOutputPixels + 1
+	if _, err := DecodeFit(hash, width, 1, FitContain); err == nil {
+		t.Errorf("DecodeFit of %dx1 pixels succeeded with the default limit, want error", width)
+	}
+	if testing.Short() {
+		t.Skip("skipping a decode above DefaultMaxOutputPixels in short mode")
+	}
+	img, err := DecodeFit(hash, width, 1, FitContain, WithMaxOutputPixels(width))
+	if err != nil {
+		t.Fatalf("DecodeFit of %dx1 pixels with a raised limit: %v", width, err)
+	}
+	if got := img.Bounds().Size(); got != image.Pt(width, 1) {
+		t.Errorf("DecodeFit size = %v, want %dx1", got, width)
+	}
+}
+
+func TestDecodeFitLetterbox(t *testing.T) {
+	hash := "LEHV6nWB2yk8pyo0adR*.7kCMdnj" // 4x3 components
+	parsed, err := Parse(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dc := parsed.factors[0]
+	// The letterbox honours WithRange like the content does.
+	img, err := DecodeFit(hash, 100, 50, FitContain, WithRange(0.2, 0.5), WithPunch(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	remap := func(v float64) uint8 { return linear(0.2 + v*0.3).sRGB() }
+	want := color.RGBA{R: remap(dc.r), G: remap(dc.g), B: remap(dc.b), A: 0xff}
+	for _, p := range []image.Point{{0, 0}, {5, 25}, {99, 49}} {
+		if got := img.RGBAAt(p.X, p.Y); got != want {
+			t.Errorf("letterbox pixel %v with WithRange(0.2, 0.5) = %v, want %v", p, got, want)
+		}
+	}
+	// The content area is the decode with the same options.
+	content, err := Decode(hash, 67, 50, WithRange(0.2, 0.5), WithPunch(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := img.RGBAAt(16+33, 25), content.RGBAAt(33, 25); got != want {
+		t.Errorf("content pixel = %v, want %v", got, want)
+	}
+}
+
+func TestDecodeMean(t *testing.T) {
+	for _, hash := range []string{"LEHV6nWB2yk8pyo0adR*.7kCMdnj", Encode(detailImage(64, 48), 9, 9)} {
+		got, err := DecodeMean(hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, _ := DecodeAverageColor(hash)
+		if got != want {
+			t.Errorf("DecodeMean(%q) = %v, want %v", hash, got, want)
+		}
+	}
+	if _, err := DecodeMean("LEHV6nWB2yk8pyo0adR*.7kCMdn"); err == nil {
+		t.Error("DecodeMean accepted a truncated hash")
+	}
+	if n := testing.AllocsPerRun(10, func() { DecodeMean("LEHV6nWB2yk8pyo0adR*.7kCMdnj") }); n != 0 {
+		t.Errorf("DecodeMean makes %v allocations, want 0", n)
+	}
+}
+
+func BenchmarkDecodeMean(b *testing.B) {
+	const hash = "LEHV6nWB2yk8pyo0adR*.7kCMdnj"
+	if n := testing.AllocsPerRun(10, func() { DecodeMean(hash) }); n != 0 {
+		b.Fatalf("DecodeMean makes %v allocations, want 0", n)
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		DecodeMean(hash)
+	}
+}
+
+func TestSwatch(t *testing.T) {
+	hash := "LEHV6nWB2yk8pyo0adR*.7kCMdnj"
+	want, err := DecodeAverageColor(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := Swatch(hash, 17)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := img.Bounds(); got != image.Rect(0, 0, 17, 17) {
+		t.Fatalf("bounds = %v, want 17x17", got)
+	}
+	for y := 0; y < 17; y++ {
+		for x := 0; x < 17; x++ {
+			if got := img.RGBAAt(x, y); got != want {
+				t.Fatalf("pixel (%d, %d) = %v, want %v", x, y, got, want)
+			}
+		}
+	}
+	if _, err := Swatch(hash, 0); err == nil {
+		t.Error("Swatch(hash, 0) succeeded, want error")
+	}
+	if _, err := Swatch("invalid", 4); err == nil {
+		t.Error("Swatch of an invalid hash succeeded, want error")
+	}
+}
+
+func TestSwatchOptions(t *testing.T) {
+	const hash = "LEHV6nWB2yk8pyo0adR*.7kCMdnj"
+	opts := []DecodeOption{WithRange(0.2, 0.5), WithDither(true), WithLenientWhitespace(true)}
+	img, err := Swatch(hash[:6]+" \n"+hash[6:], 9, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The swatch is what Decode gives for a hash of the DC alone.
+	want, err := Decode("00"+hash[2:6], 9, 9, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(img.Pix, want.Pix) {
+		t.Error("Swatch with options differs from Decode of the DC")
+	}
+	if _, err := Swatch(hash, 9, WithMaxOutputPixels(80)); err == nil {
+		t.Error("Swatch above WithMaxOutputPixels succeeded, want error")
+	}
+	if _, err := Swatch(hash, 9, WithPunch(-1)); !errors.Is(err, ErrInvalidPunch) {
+		t.Errorf("Swatch with WithPunch(-1) = %v, want ErrInvalidPunch", err)
+	}
+}
+
+func TestDecodeOpaque(t *testing.T) {
+	// Blurhash has no alpha, so even a source with a radial alpha decodes opaque.
+	radial := image.NewNRGBA(image.Rect(0, 0, 32, 32))
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 32; x++ {
+			d := math.Hypot(float64(x)-15.5, float64(y)-15.5) / 16
+			radial.SetNRGBA(x, y, color.NRGBA{R: 0xc0, G: 0x40, B: 0x20, A: uint8(255 * clamp(0, 1, 1-d))})
+		}
+	}
+	for _, hash := range []string{"LEHV6nWB2yk8pyo0adR*.7kCMdnj", "000000", Encode(detailImage(64, 48), 9, 9), Encode(radial, 4, 4)} {
+		for _, dither := range []bool{false, true} {
+			img, err := Decode(hash, 37, 23, WithDither(dither))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !img.Opaque() {
+				t.Errorf("Decode(%q) with dither %v is not opaque", hash, dither)
+			}
+		}
+	}
+}
+
+func TestWithRange(t *testing.T) {
+	hash := "LEHV6nWB2yk8pyo0adR*.7kCMdnj"
+	want, err := Decode(hash, 32, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := Decode(hash, 32, 32, WithRange(0, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Pix, want.Pix) {
+		t.Error("WithRange(0, 1) changes the decoded image")
+	}
+
+	// A flat hash decodes to its DC color exactly, so the remap is easy to predict.
+	for _, v := range []uint8{0x00, 0x40, 0x80, 0xff} {
+		hash := "00" + string(append4Base83(nil, int(v)<<16|int(v)<<8|int(v)))
+		img, err := Decode(hash, 4, 4, WithRange(0.25, 0.75))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := linear(0.25 + sRGB(v).linear()*0.5).sRGB()
+		for i := 0; i < len(img.Pix); i += 4 {
+			if p := img.Pix[i : i+4]; p[0] != w || p[1] != w || p[2] != w || p[3] != 0xff {
+				t.Fatalf("%s: pixel %v with WithRange(0.25, 0.75), want %d", hash, p, w)
+			}
+		}
+	}
+}
+
+func TestDecodeRegion(t *testing.T) {
+	hash := "LEHV6nWB2yk8pyo0adR*.7kCMdnj"
+	for _, full := range []image.Rectangle{image.Rect(0, 0, 64, 48), image.Rect(10, 20, 74, 68)} {
+		want, err := Decode(hash, full.Dx(), full.Dy(), WithDither(true))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, crop := range []image.Rectangle{
+			full,
+			image.Rect(0, 0, 1, 1).Add(full.Min),
+			image.Rect(5, 7, 30, 19).Add(full.Min),
+			image.Rect(40, 30, 100, 100).Add(full.Min),
+		} {
+			got, err := DecodeRegion(hash, full, crop, WithDither(true))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if wb := crop.Intersect(full); got.Bounds() != wb {
+				t.Errorf("DecodeRegion(%v, %v) has bounds %v, want %v", full, crop, got.Bounds(), wb)
+				continue
+			}
+			b := got.Bounds()
+			for y := b.Min.Y; y < b.Max.Y; y++ {
+				for x := b.Min.X; x < b.Max.X; x++ {
+					g := got.RGBAAt(x, y)
+					w := want.RGBAAt(x-full.Min.X, y-full.Min.Y)
+					if g != w {
+						t.Fatalf("DecodeRegion(%v, %v) at (%d, %d) = %v, want %v", full, crop, x, y, g, w)
+					}
+				}
+			}
+		}
+	}
+	if _, err := DecodeRegion(hash, image.Rect(0, 0, 8, 8), image.Rect(10, 10, 20, 20)); err == nil {
+		t.Error("DecodeRegion with a crop outside the image succeeded, want error")
+	}
+}
+
+func TestAverageColorLinearNormalized(t *testing.T) {
+	// The DC of the hash is sRGB (151, 150, 149).
+	r, g, b, err := AverageColorLinearNormalized("LEHV6nWB2yk8pyo0adR*.7kCMdnj")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [3]float64{0.30946892281750854, 0.3049873140698863, 0.3005437944157765}
+	for i, v := range [3]float64{r, g, b} {
+		if math.Abs(v-want[i]) > 1e-12 {
+			t.Errorf("channel %d = %v, want %v", i, v, want[i])
+		}
+	}
+	r, g, b, err = AverageColorLinearNormalized(EncodeColor(color.White, 1, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r != 1 || g != 1 || b != 1 {
+		t.Errorf("white = %v, %v, %v, want 1, 1, 1", r, g, b)
+	}
+	if _, _, _, err := AverageColorLinearNormalized("invalid"); err == nil {
+		t.Error("AverageColorLinearNormalized of an invalid hash succeeded, want error")
+	}
+}
+
+func TestDecodeDraw(t *testing.T) {
+	hash := "LEHV6nWB2yk8pyo0adR*.7kCMdnj"
+	want, err := Decode(hash, 40, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := image.NewNRGBA(image.Rect(-3, 7, 37, 37))
+	if err := DecodeDraw(dst, hash); err != nil {
+		t.Fatal(err)
+	}
+	b := dst.Bounds()
+	for y := 0; y < 30; y++ {
+		for x := 0; x < 40; x++ {
+			w := want.RGBAAt(x, y)
+			if g := dst.NRGBAAt(b.Min.X+x, b.Min.Y+y); g != (color.NRGBA{R: w.R, G: w.G, B: w.B, A: w.A}) {
+				t.Fatalf("pixel (%d, %d) = %v, want %v", x, y, g, w)
+			}
+		}
+	}
+	if err := DecodeDraw(dst, "invalid"); err == nil {
+		t.Error("DecodeDraw of an invalid hash succeeded, want error")
+	}
+}
+
+func TestDecodeMalformed(t *testing.T) {
+	valid := "LEHV6nWB2yk8pyo0adR*.7kCMdnj"
+	tests := []struct {
+		category string
+		hash     string
+		// ac is set when only AC digits are malformed, which DecodeAverageColor does not read.
+		ac bool
+	}{
+		{"empty", "", false},
+		{"single character", "L", false},
+		{"shorter than the header", "LEHV6", false},
+		{"multibyte in the size flag", "é" + valid[2:], false},
+		{"multibyte in the DC", valid[:2] + "日0" + valid[6:], false},
+		{"multibyte in the AC", valid[:10] + "é" + valid[12:], true},
+		{"invalid byte", valid[:10] + "\xff" + valid[11:], true},
+		{"space", valid[:10] + " " + valid[11:], true},
+		{"size flag out of range", "~" + valid[1:], false},
+		{"longer than the shape", valid + "0", false},
+		{"shorter than the shape", valid[:len(valid)-2], false},
+		{"shape of another hash", "0" + valid[1:], false},
+	}
+	readers := map[string]func(hash string) error{
+		"Validate": Validate,
+		"Parse": func(hash string) error {
+			_, err := Parse(hash)
+			return err
+		},
+		"Decode": func(hash string) error {
+			_, err := Decode(hash, 8, 8)
+			return err
+		},
+		"DecodeAverageColor": func(hash string) error {
+			_, err := DecodeAverageColor(hash)
+			return err
+		},
+	}
+	for _, tt := range tests {
+		for name, read := range readers {
+			if tt.ac && name == "DecodeAverageColor" {
+				continue
+			}
+			if err := read(tt.hash); !errors.Is(err, ErrInvalidHash) {
+				t.Errorf("%s: %s(%q) error %v, want ErrInvalidHash", tt.category, name, tt.hash, err)
+			}
+		}
+		if tt.ac {
+			want, _ := DecodeAverageColor(valid)
+			if got, err := DecodeAverageColor(tt.hash); err != nil || got != want {
+				t.Errorf("%s: DecodeAverageColor(%q) = %v, %v, want %v", tt.category, tt.hash, got, err, want)
+			}
+		}
+	}
+}
+
+func TestWithLenientWhitespace(t *testing.T) {
+	const clean = "LEHV6nWB2yk8pyo0adR*.7kCMdnj"
+	// decoders decode a hash with opts and return the pixels.
+	decoders := map[string]func(hash string, opts ...DecodeOption) ([]byte, error){
+		"Decode": func(hash string, opts ...DecodeOption) ([]byte, error) {
+			img, err := Decode(hash, 8, 6, opts...)
+			if err != nil {
+				return nil, err
+			}
+			return img.Pix, nil
+		},
+		"DecodeFunc": func(hash string, opts ...DecodeOption) ([]byte, error) {
+			var pix []byte
+			err := DecodeFunc(hash, 8, 6, func(y int, row []byte) { pix = append(pix, row...) }, opts...)
+			return pix, err
+		},
+		"Decoder.Decode": func(hash string, opts ...DecodeOption) ([]byte, error) {
+			img, err := NewDecoder(8, 6).Decode(hash, opts...)
+			if err != nil {
+				return nil, err
+			}
+			return img.Pix, nil
+		},
+		"DecodeFit": func(hash string, opts ...DecodeOption) ([]byte, error) {
+			img, err := DecodeFit(hash, 8, 6, FitContain, opts...)
+			if err != nil {
+				return nil, err
+			}
+			return img.Pix, nil
+		},
+		"DecodePNG": func(hash string, opts ...DecodeOption) ([]byte, error) {
+			var buf bytes.Buffer
+			err := DecodePNG(&buf, hash, 8, 6, opts...)
+			return buf.Bytes(), err
+		},
+		"DecodeCompact": func(hash string, opts ...DecodeOption) ([]byte, error) {
+			img, err := DecodeCompact(hash, 8, 6, opts...)
+			if err != nil {
+				return nil, err
+			}
+			return img.Pix, nil
+		},
+	}
+	compact := EncodeCompact(readPNG(t, "photo.png"), 4, 3)
+	for name, decode := range decoders {
+		valid := clean
+		if name == "DecodeCompact" {
+			valid = compact
+		}
+		want, err := decode(valid)
+		if err != nil {
+			t.Fatalf("%s(%q): %v", name, valid, err)
+		}
+		// U+00A0 is the no-break space that often comes with text copied from web pages.
+		spaced := []string{
+			" " + valid,
+			valid + "\n",
+			"\t " + valid + " \r\n",
+			"\u00a0" + valid + "\u00a0",
+			valid[:5] + " " + valid[5:11] + "\n" + valid[11:],
+		}
+		for _, hash := range spaced {
+			for _, opts := range [][]DecodeOption{nil, {WithLenientWhitespace(false)}} {
+				if _, err := decode(hash, opts...); !errors.Is(err, ErrInvalidHash) {
+					t.Errorf("%s(%q) in strict mode: error %v, want ErrInvalidHash", name, hash, err)
+				}
+			}
+			got, err := decode(hash, WithLenientWhitespace(true))
+			if err != nil {
+				t.Errorf("%s(%q) in lenient mode: %v", name, hash, err)
+			} else if !bytes.Equal(got, want) {
+				t.Errorf("%s(%q) in lenient mode decodes differently from %q", name, hash, valid)
+			}
+		}
+		// Lenient mode only drops whitespace: a homoglyph of a base83 character,
+		// here a Cyrillic A, and a hash of only whitespace are still invalid.
+		for _, hash := range []string{valid[:3] + "\u0410" + valid[4:], " \n\t"} {
+			if _, err := decode(hash, WithLenientWhitespace(true)); err == nil {
+				t.Errorf("%s(%q) in lenient mode succeeded, want error", name, hash)
+			}
+		}
+	}
+}
+
+func TestDecodeTruncated(t *testing.T) {
+	readers := map[string]func(hash string) error{
+		"Parse": func(hash string) error {
+			_, err := Parse(hash)
+			return err
+		},
+		"Components": func(hash string) error {
+			_, _, err := Components(hash)
+			return err
+		},
+		"Decode": func(hash string) error {
+			_, err := Decode(hash, 8, 8)
+			return err
+		},
+		"DecodeAverageColor": func(hash string) error {
+			_, err := DecodeAverageColor(hash)
+			return err
+		},
+		"DecodeComponents": func(hash string) error {
+			_, _, _, _, _, err := DecodeComponents(hash)
+			return err
+		},
+		"Inspect": func(hash string) error {
+			_, err := Inspect(hash)
+			return err
+		},
+	}
+	hashes := []string{"000000", "LEHV6nWB2yk8pyo0adR*.7kCMdnj", Encode(detailImage(32, 32), 9, 9)}
+	for _, hash := range hashes {
+		for n := 0; n < len(hash); n++ {
+			truncated := hash[:n]
+			for name, read := range readers {
+				err := read(truncated)
+				if !errors.Is(err, ErrInvalidHash) {
+					t.Errorf("%s(%q) = %v, want ErrInvalidHash", name, truncated, err)
+					continue
+				}
+				if want := fmt.Sprintf("truncated at offset %d", n); !strings.Contains(err.Error(), want) {
+					t.Errorf("%s(%q) = %q, want it to contain %q", name, truncated, err, want)
+				}
+			}
+		}
+		if err := readers["Parse"](hash); err != nil {
+			t.Errorf("Parse(%q): %v", hash, err)
+		}
+	}
+}
+
+func TestWithMaxOutputPixels(t *testing.T) {
+	hash := "LEHV6nWB2yk8pyo0adR*.7kCMdnj"
+	for _, size := range [][2]int{{1 << 20, 1 << 20}, {math.MaxInt32, 2}, {DefaultMaxOutputPixels + 1, 1}} {
+		if _, err := Decode(hash, size[0], size[1]); err == nil {
+			t.Errorf("Decode(%q, %d, %d) succeeded, want error", hash, size[0], size[1])
+		}
+	}
+	if _, err := Decode(hash, 640, 480); err != nil {
+		t.Errorf("Decode(%q, 640, 480): %v", hash, err)
+	}
+	if _, err := Decode(hash, 100, 100, WithMaxOutputPixels(10000)); err != nil {
+		t.Errorf("Decode(%q, 100, 100) with a limit of 10000 pixels: %v", hash, err)
+	}
+	if _, err := Decode(hash, 101, 100, WithMaxOutputPixels(10000)); err == nil {
+		t.Errorf("Decode(%q, 101, 100) with a limit of 10000 pixels succeeded, want error", hash)
+	}
+	if err := DecodeFunc(hash, 1<<20, 1<<20, func(int, []byte) {}); err == nil {
+		t.Errorf("DecodeFunc(%q, %d, %d) succeeded, want error", hash, 1<<20, 1<<20)
+	}
+}
+
+func TestDecodeLinearPix(t *testing.T) {
+	for _, hash := range []string{"LEHV6nWB2yk8pyo0adR*.7kCMdnj", Encode(detailImage(64, 48), 9, 9)} {
+		const width, height = 37, 23
+		pix, err := DecodeLinearPix(hash, width, height)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pix) != width*height*3 {
+			t.Fatalf("len(pix) = %d, want %d", len(pix), width*height*3)
+		}
+		img, err := Decode(hash, width, height)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				p := pix[(y*width+x)*3:][:3]
+				q := img.Pix[img.PixOffset(x, y):]
+				for c := 0; c < 3; c++ {
+					if got := Delinearize(p[c]); got != q[c] {
+						t.Fatalf("%q: pixel (%d, %d) channel %d converts to %d, want %d", hash, x, y, c, got, q[c])
+					}
+				}
+			}
+		}
+	}
+	if _, err := DecodeLinearPix("invalid", 8, 8); err == nil {
+		t.Error("DecodeLinearPix of an invalid hash succeeded, want error")
+	}
+	if _, err := DecodeLinearPix("LEHV6nWB2yk8pyo0adR*.7kCMdnj", 0, 8); err == nil {
+		t.Error("DecodeLinearPix at 0x8 succeeded, want error")
+	}
+}
+
+func TestDecodeLinearPixOptions(t *testing.T) {
+	const hash = "LEHV6nWB2yk8pyo0adR*.7kCMdnj"
+	const width, height = 37, 23
+	opts := []DecodeOption{WithPunch(2), WithRange(0.2, 0.5), WithLenientWhitespace(true)}
+	pix, err := DecodeLinearPix("\t"+hash+"\n", width, height, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := Decode(hash, width, height, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, v := range pix {
+		if v < 0.2 || v > 0.5 {
+			t.Fatalf("pix[%d] = %v outside the range 0.2..0.5", i, v)
+		}
+		if got, want := Delinearize(v), img.Pix[i/3*4+i%3]; got != want {
+			t.Fatalf("pix[%d] converts to %d, want %d as with Decode", i, got, want)
+		}
+	}
+	if _, err := DecodeLinearPix(hash, width, height, WithMaxOutputPixels(width*height-1)); err == nil {
+		t.Error("DecodeLinearPix above WithMaxOutputPixels succeeded, want error")
+	}
+	if _, err := DecodeLinearPix(hash, width, height, WithPunch(0)); !errors.Is(err, ErrInvalidPunch) {
+		t.Errorf("DecodeLinearPix with WithPunch(0) = %v, want ErrInvalidPunch", err)
+	}
+}
+
+func TestDecodePaletted(t *testing.T) {
+	hash := "LEHV6nWB2yk8pyo0adR*.7kCMdnj"
+	var palette color.Palette
+	for i := 0; i < 8; i++ {
+		palette = append(palette, color.RGBA{R: uint8(i&1) * 0xff, G: uint8(i>>1&1) * 0xff, B: uint8(i>>2) * 0xff, A: 0xff})
+	}
+	img, err := DecodePaletted(hash, 32, 24, palette)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := img.Bounds(); got != image.Rect(0, 0, 32, 24) {
+		t.Errorf("bounds %v, want %v", got, image.Rect(0, 0, 32, 24))
+	}
+	if got, ok := img.ColorModel().(color.Palette); !ok || len(got) != len(palette) {
+		t.Errorf("color model %v, want the 8-color palette", img.ColorModel())
+	}
+	want, err := Decode(hash, 32, 24)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for y := 0; y < 24; y++ {
+		for x := 0; x < 32; x++ {
+			if i, w := img.ColorIndexAt(x, y), uint8(palette.Index(want.At(x, y))); i != w {
+				t.Fatalf("index at (%d, %d) = %d, want %d", x, y, i, w)
+			}
+		}
+	}
+
+	for _, n := range []int{0, 257} {
+		if _, err := DecodePaletted(hash, 32, 24, make(color.Palette, n)); err == nil {
+			t.Errorf("DecodePaletted with %d colors succeeded, want error", n)
+		}
+	}
+	large := make(color.Palette, 256)
+	for i := range large {
+		large[i] = color.Gray{Y: uint8(i)}
+	}
+	if _, err := DecodePaletted(hash, 32, 24, large); err != nil {
+		t.Errorf("DecodePaletted with 256 colors: %v", err)
+	}
+}
+
+func TestWithNearest(t *testing.T) {
+	hash := "LEHV6nWB2yk8pyo0adR*.7kCMdnj"
+	var palette color.Palette
+	for i := 0; i < 8; i++ {
+		palette = append(palette, color.RGBA{R: uint8(i&1) * 0xff, G: uint8(i>>1&1) * 0xff, B: uint8(i>>2) * 0xff, A: 0xff})
+	}
+	// byLuma picks the entry with the closest luma, ignoring hue.
+	byLuma := func(p color.Palette, c color.Color) int {
+		luma := func(c color.Color) int {
+			return int(color.GrayModel.Convert(c).(color.Gray).Y)
+		}
+		best := 0
+		for i, e := range p {
+			if absInt(luma(e)-luma(c)) < absInt(luma(p[best])-luma(c)) {
+				best = i
+			}
+		}
+		return best
+	}
+	want, err := Decode(hash, 32, 24)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := DecodePaletted(hash, 32, 24, palette, WithNearest(byLuma))
+	if err != nil {
+		t.Fatal(err)
+	}
+	def, err := DecodePaletted(hash, 32, 24, palette, WithNearest(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	differ := false
+	for y := 0; y < 24; y++ {
+		for x := 0; x < 32; x++ {
+			if i, w := img.ColorIndexAt(x, y), uint8(byLuma(palette, want.At(x, y))); i != w {
+				t.Fatalf("index at (%d, %d) = %d, want %d", x, y, i, w)
+			}
+			if i, w := def.ColorIndexAt(x, y), uint8(palette.Index(want.At(x, y))); i != w {
+				t.Fatalf("WithNearest(nil): index at (%d, %d) = %d, want %d", x, y, i, w)
+			}
+			differ = differ || img.ColorIndexAt(x, y) != def.ColorIndexAt(x, y)
+		}
+	}
+	if !differ {
+		t.Error("the luma metric gives the same mapping as the default")
+	}
+}
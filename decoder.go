@@ -0,0 +1,135 @@
+// Copyright 2021-2022 Nao Yonashiro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blurhash
+
+import (
+	"image"
+	"math"
+)
+
+// Decoder decodes hashes at a fixed size. It caches the basis tables for that size,
+// so decoding many hashes with one Decoder is cheaper than calling Decode for each.
+// A Decoder is not safe for concurrent use.
+type Decoder struct {
+	width, height int
+	xCos, yCos    []float64
+}
+
+// NewDecoder returns a Decoder producing width x height images.
+func NewDecoder(width, height int) *Decoder {
+	d := &Decoder{}
+	d.Reset(width, height)
+	return d
+}
+
+// Reset changes the output size of d, reusing its memory where possible.
+func (d *Decoder) Reset(width, height int) {
+	d.width, d.height = width, height
+	if width <= 0 || height <= 0 {
+		return
+	}
+	d.xCos = buildCosTable(d.xCos, width)
+	d.yCos = buildCosTable(d.yCos, height)
+}
+
+// Decode reconstructs the image represented by hash.
+func (d *Decoder) Decode(hash string, opts ...DecodeOption) (*image.RGBA, error) {
+	cfg, err := newDecodeConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.checkSize(d.width, d.height); err != nil {
+		return nil, err
+	}
+	parsed, err := cfg.parse(hash)
+	if err != nil {
+		return nil, err
+	}
+	return d.decode(parsed.punch(cfg.punch), &cfg), nil
+}
+
+func (d *Decoder) decode(parsed *Parsed, cfg *decodeConfig) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, d.width, d.height))
+	parsed.renderCos(d.xCos, d.yCos, img.Rect, func(x, y int, c factor) {
+		cfg.store(img.Pix[img.PixOffset(x, y):], x, y, c)
+	})
+	return img
+}
+
+// DecodeSizes decodes hash once for each of sizes, given as width, height pairs.
+// The hash is parsed only once.
+func DecodeSizes(hash string, sizes [][2]int, opts ...DecodeOption) ([]*image.RGBA, error) {
+	cfg, err := newDecodeConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	for _, size := range sizes {
+		if err := cfg.checkSize(size[0], size[1]); err != nil {
+			return nil, err
+		}
+	}
+	parsed, err := cfg.parse(hash)
+	if err != nil {
+		return nil, err
+	}
+	parsed = parsed.punch(cfg.punch)
+
+	imgs := make([]*image.RGBA, len(sizes))
+	var d Decoder
+	for i, size := range sizes {
+		d.Reset(size[0], size[1])
+		imgs[i] = d.decode(parsed, &cfg)
+	}
+	return imgs, nil
+}
+
+// buildCosTable stores cos(π·x·i/n) at table[x*9+i] for every pixel x and
+// every possible component i, reusing the memory of table if it is large enough.
+func buildCosTable(table []float64, n int) []float64 {
+	if cap(table) < n*9 {
+		table = make([]float64, n*9)
+	}
+	table = table[:n*9]
+	// cos(π·(n-x)·i/n) = (-1)^i·cos(π·x·i/n), so only the first half is computed.
+	half := n / 2
+	for x := 0; x <= half; x++ {
+		for i := 0; i < 9; i++ {
+			table[x*9+i] = math.Cos(math.Pi * float64(x*i) / float64(n))
+		}
+	}
+	for x := half + 1; x < n; x++ {
+		mirror := table[(n-x)*9:]
+		for i := 0; i < 9; i++ {
+			if i%2 == 0 {
+				table[x*9+i] = mirror[i]
+			} else {
+				table[x*9+i] = -mirror[i]
+			}
+		}
+	}
+	return table
+}
+
+// buildCosTableRange is like buildCosTable but only holds the pixels x in range
+// min..max-1, storing cos(π·x·i/n) at table[(x-min)*9+i].
+func buildCosTableRange(n, min, max int) []float64 {
+	table := make([]float64, (max-min)*9)
+	for x := min; x < max; x++ {
+		for i := 0; i < 9; i++ {
+			table[(x-min)*9+i] = math.Cos(math.Pi * float64(x*i) / float64(n))
+		}
+	}
+	return table
+}
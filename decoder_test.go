@@ -0,0 +1,117 @@
+// Copyright 2021-2022 Nao Yonashiro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blurhash
+
+import (
+	"bytes"
+	"math"
+	"testing"
+)
+
+func TestDecoderReset(t *testing.T) {
+	hashes := []string{
+		"LEHV6nWB2yk8pyo0adR*.7kCMdnj",
+		Encode(detailImage(64, 48), 9, 9),
+	}
+	d := NewDecoder(64, 48)
+	for _, size := range [][2]int{{64, 48}, {13, 200}, {64, 48}, {1, 1}} {
+		d.Reset(size[0], size[1])
+		for _, hash := range hashes {
+			want, err := Decode(hash, size[0], size[1])
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := d.Decode(hash)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Rect != want.Rect || !bytes.Equal(got.Pix, want.Pix) {
+				t.Errorf("%dx%d: Decoder.Decode(%q) differs from Decode", size[0], size[1], hash)
+			}
+		}
+	}
+
+	d.Reset(0, 10)
+	if _, err := d.Decode(hashes[0]); err == nil {
+		t.Error("Decode after Reset(0, 10) succeeded, want error")
+	}
+}
+
+func TestDecodeSizes(t *testing.T) {
+	hash := "LEHV6nWB2yk8pyo0adR*.7kCMdnj"
+	sizes := [][2]int{{32, 32}, {320, 180}, {7, 50}}
+	for _, opts := range [][]DecodeOption{nil, {WithPunch(1.5), WithDither(true)}} {
+		imgs, err := DecodeSizes(hash, sizes, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(imgs) != len(sizes) {
+			t.Fatalf("DecodeSizes returned %d images, want %d", len(imgs), len(sizes))
+		}
+		for i, size := range sizes {
+			want, err := Decode(hash, size[0], size[1], opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := imgs[i]; got.Rect != want.Rect || !bytes.Equal(got.Pix, want.Pix) {
+				t.Errorf("DecodeSizes image %d (%dx%d) differs from Decode", i, size[0], size[1])
+			}
+		}
+	}
+	if _, err := DecodeSizes(hash, [][2]int{{32, 32}, {0, 10}}); err == nil {
+		t.Error("DecodeSizes with an empty size succeeded, want error")
+	}
+	if _, err := DecodeSizes("invalid", sizes); err == nil {
+		t.Error("DecodeSizes of an invalid hash succeeded, want error")
+	}
+}
+
+func TestBuildCosTable(t *testing.T) {
+	for n := 1; n <= 1024; n++ {
+		got, want := buildCosTable(nil, n), buildCosTableRange(n, 0, n)
+		for i := range want {
+			if d := math.Abs(got[i] - want[i]); d > 1e-14 {
+				t.Fatalf("n=%d: table[%d] = %v, want %v", n, i, got[i], want[i])
+			}
+		}
+	}
+}
+
+func TestBuildCosTableDecode(t *testing.T) {
+	hashes := []string{
+		"LEHV6nWB2yk8pyo0adR*.7kCMdnj",
+		"LGF5]+Yk^6#M@-5c,1J5@[or[Q6.",
+		Encode(detailImage(64, 48), 9, 9),
+	}
+	for _, size := range [][2]int{{1, 1}, {2, 3}, {32, 32}, {100, 75}, {333, 17}, {640, 480}} {
+		d := NewDecoder(size[0], size[1])
+		naive := NewDecoder(size[0], size[1])
+		naive.xCos = buildCosTableRange(size[0], 0, size[0])
+		naive.yCos = buildCosTableRange(size[1], 0, size[1])
+		for _, hash := range hashes {
+			got, err := d.Decode(hash)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, err := naive.Decode(hash)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got.Pix, want.Pix) {
+				t.Errorf("%q at %dx%d differs from the naive table", hash, size[0], size[1])
+			}
+		}
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright 2021-2022 Nao Yonashiro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blurhash
+
+import (
+	"image"
+	"math"
+)
+
+// Downsample returns a copy of img scaled down to fit within maxW x maxH,
+// preserving the aspect ratio. Pixels are box-filtered in linear light, which
+// avoids the darkening of naive sRGB averaging. Colors are weighted by their alpha,
+// so fully transparent pixels do not contribute to them. img is never scaled up.
+func Downsample(img image.Image, maxW, maxH int) *image.RGBA {
+	bounds := img.Bounds()
+	imgW, imgH := bounds.Dx(), bounds.Dy()
+	if maxW < 1 {
+		maxW = 1
+	}
+	if maxH < 1 {
+		maxH = 1
+	}
+	scale := math.Min(1, math.Min(float64(maxW)/float64(imgW), float64(maxH)/float64(imgH)))
+	outW := int(math.Max(1, math.Round(float64(imgW)*scale)))
+	outH := int(math.Max(1, math.Round(float64(imgH)*scale)))
+
+	return boxResize(img, outW, outH)
+}
+
+// DecodeMipmaps decodes hash at baseWidth x baseHeight and returns it followed by
+// successively halved levels, each box-filtered in linear light from the previous
+// one, down to 1x1. An odd size is rounded down, and a size of 1 stays 1.
+func DecodeMipmaps(hash string, baseWidth, baseHeight int, opts ...DecodeOption) ([]*image.RGBA, error) {
+	img, err := Decode(hash, baseWidth, baseHeight, opts...)
+	if err != nil {
+		return nil, err
+	}
+	levels := []*image.RGBA{img}
+	for w, h := baseWidth, baseHeight; w > 1 || h > 1; {
+		w, h = maxInt(1, w/2), maxInt(1, h/2)
+		img = boxResize(img, w, h)
+		levels = append(levels, img)
+	}
+	return levels, nil
+}
+
+// boxResize returns img resized to outW x outH, averaging the source pixels
+// covered by each output pixel in linear light. A source pixel that straddles
+// two output pixels contributes to both in proportion to the area it covers,
+// so every source pixel has the same total weight even when the sizes do not
+// divide. Colors are weighted by their alpha, so transparent pixels do not
+// darken their neighbours, and the result is premultiplied again by the
+// average alpha.
+func boxResize(img image.Image, outW, outH int) *image.RGBA {
+	bounds := img.Bounds()
+	imgW, imgH := bounds.Dx(), bounds.Dy()
+	out := image.NewRGBA(image.Rect(0, 0, outW, outH))
+	if imgW == 0 || imgH == 0 {
+		return out
+	}
+	fastAt, _ := fastAccessor(img)
+	// unpremultiply returns the 8-bit straight value of the premultiplied v.
+	unpremultiply := func(v, a uint32) sRGB {
+		if v >= a {
+			return 0xff
+		}
+		return sRGB(v * 0xffff / a >> 8)
+	}
+	xTaps, yTaps := boxTaps(imgW, outW), boxTaps(imgH, outH)
+	for oy := 0; oy < outH; oy++ {
+		for ox := 0; ox < outW; ox++ {
+			var sum factor
+			var alpha, area float64
+			for _, ty := range yTaps[oy] {
+				for _, tx := range xTaps[ox] {
+					w := tx.w * ty.w
+					area += w
+					pR, pG, pB, pA := fastAt(bounds.Min.X+tx.i, bounds.Min.Y+ty.i)
+					if pA == 0 {
+						continue
+					}
+					a := float64(pA) / 0xffff * w
+					sum.r += unpremultiply(pR, pA).linear() * a
+					sum.g += unpremultiply(pG, pA).linear() * a
+					sum.b += unpremultiply(pB, pA).linear() * a
+					alpha += a
+				}
+			}
+			if alpha == 0 {
+				continue
+			}
+			sum.Scale(1 / alpha)
+			a := uint32(alpha/area*0xff + 0.5)
+			p := out.Pix[out.PixOffset(ox, oy):]
+			p[0] = uint8((uint32(linear(sum.r).sRGB())*a + 0x7f) / 0xff)
+			p[1] = uint8((uint32(linear(sum.g).sRGB())*a + 0x7f) / 0xff)
+			p[2] = uint8((uint32(linear(sum.b).sRGB())*a + 0x7f) / 0xff)
+			p[3] = uint8(a)
+		}
+	}
+	return out
+}
+
+// boxTap is a source pixel i covered by an output pixel, and the part w of it covered.
+type boxTap struct {
+	i int
+	w float64
+}
+
+// boxTaps returns for each of n output pixels the taps of the size source
+// pixels it covers, when size pixels are scaled to n.
+func boxTaps(size, n int) [][]boxTap {
+	taps := make([][]boxTap, n)
+	for o := range taps {
+		// Work in units of 1/n source pixels, so that the bounds are exact.
+		lo, hi := o*size, (o+1)*size
+		for i := lo / n; i*n < hi; i++ {
+			w := minInt(hi, (i+1)*n) - maxInt(lo, i*n)
+			taps[o] = append(taps[o], boxTap{i: i, w: float64(w) / float64(n)})
+		}
+	}
+	return taps
+}
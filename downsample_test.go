@@ -0,0 +1,178 @@
+// Copyright 2021-2022 Nao Yonashiro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blurhash
+
+import (
+	"image"
+	"image/color"
+	"math/rand"
+	"testing"
+)
+
+func checkerboard(w, h int) *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if (x+y)%2 == 0 {
+				img.SetGray(x, y, color.Gray{Y: 0xff})
+			}
+		}
+	}
+	return img
+}
+
+func TestDownsampleCheckerboard(t *testing.T) {
+	img := Downsample(checkerboard(64, 64), 32, 32)
+	if got := img.Bounds().Size(); got != image.Pt(32, 32) {
+		t.Fatalf("size = %v, want 32x32", got)
+	}
+	// Half of the light of white is sRGB 188. Averaging the sRGB values would
+	// give the much darker 128.
+	const want, naive = 188, 128
+	for i := 0; i < len(img.Pix); i += 4 {
+		p := img.Pix[i : i+4]
+		if p[0] != want || p[1] != want || p[2] != want || p[3] != 0xff {
+			t.Fatalf("pixel %d = %v, want gray %d (naive average %d)", i/4, p, want, naive)
+		}
+	}
+}
+
+func TestDownsampleAspect(t *testing.T) {
+	tests := []struct {
+		w, h, maxW, maxH int
+		want             image.Point
+	}{
+		{64, 32, 16, 16, image.Pt(16, 8)},
+		{32, 64, 16, 16, image.Pt(8, 16)},
+		{10, 10, 100, 100, image.Pt(10, 10)},
+		{1000, 1, 10, 10, image.Pt(10, 1)},
+		{10, 10, 0, 0, image.Pt(1, 1)},
+	}
+	for _, tt := range tests {
+		if got := Downsample(checkerboard(tt.w, tt.h), tt.maxW, tt.maxH).Bounds().Size(); got != tt.want {
+			t.Errorf("Downsample(%dx%d, %d, %d) size = %v, want %v", tt.w, tt.h, tt.maxW, tt.maxH, got, tt.want)
+		}
+	}
+}
+
+func TestDownsampleTransparent(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+	img.SetNRGBA(0, 0, color.NRGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff})
+	img.SetNRGBA(1, 0, color.NRGBA{R: 0x12, G: 0x34, B: 0x56, A: 0})
+	got := Downsample(img, 1, 1).Pix
+	// The transparent pixel has no color, so the result is white at half opacity.
+	if want := []byte{0x80, 0x80, 0x80, 0x80}; string(got) != string(want) {
+		t.Errorf("Downsample = %v, want %v", got, want)
+	}
+
+	transparent := Downsample(image.NewNRGBA(image.Rect(0, 0, 4, 4)), 2, 2)
+	for i, v := range transparent.Pix {
+		if v != 0 {
+			t.Fatalf("Downsample of a transparent image: byte %d = %d, want 0", i, v)
+		}
+	}
+}
+
+func TestDownsampleAlpha(t *testing.T) {
+	transparent := Downsample(image.NewAlpha(image.Rect(0, 0, 4, 4)), 2, 2)
+	for i, v := range transparent.Pix {
+		if v != 0 {
+			t.Fatalf("Downsample of a transparent mask: byte %d = %d, want 0", i, v)
+		}
+	}
+	// A mask is white at the opacity of each pixel, not an opaque gray.
+	mask := image.NewAlpha16(image.Rect(0, 0, 4, 4))
+	for i := range mask.Pix {
+		mask.Pix[i] = 0x80
+	}
+	for i, v := range Downsample(mask, 2, 2).Pix {
+		if v != 0x80 {
+			t.Fatalf("Downsample of a half-transparent mask: byte %d = %#x, want 0x80", i, v)
+		}
+	}
+}
+
+func TestDownsamplePremultiplied(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	img := image.NewNRGBA(image.Rect(0, 0, 37, 23))
+	rng.Read(img.Pix)
+	out := Downsample(img, 9, 9)
+	for i := 0; i < len(out.Pix); i += 4 {
+		p := out.Pix[i : i+4]
+		if p[0] > p[3] || p[1] > p[3] || p[2] > p[3] {
+			t.Fatalf("pixel %d = %v is not valid premultiplied RGBA", i/4, p)
+		}
+	}
+}
+
+func TestDecodeMipmaps(t *testing.T) {
+	hash := Encode(readPNG(t, "photo.png"), 4, 3)
+	tests := []struct {
+		w, h int
+		want []image.Point
+	}{
+		{64, 48, []image.Point{{64, 48}, {32, 24}, {16, 12}, {8, 6}, {4, 3}, {2, 1}, {1, 1}}},
+		{37, 10, []image.Point{{37, 10}, {18, 5}, {9, 2}, {4, 1}, {2, 1}, {1, 1}}},
+		{1, 8, []image.Point{{1, 8}, {1, 4}, {1, 2}, {1, 1}}},
+		{1, 1, []image.Point{{1, 1}}},
+	}
+	avg, err := DecodeAverageColor(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		levels, err := DecodeMipmaps(hash, tt.w, tt.h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(levels) != len(tt.want) {
+			t.Fatalf("DecodeMipmaps(%dx%d) returned %d levels, want %d", tt.w, tt.h, len(levels), len(tt.want))
+		}
+		for i, level := range levels {
+			if got := level.Bounds().Size(); got != tt.want[i] {
+				t.Errorf("DecodeMipmaps(%dx%d) level %d is %v, want %v", tt.w, tt.h, i, got, tt.want[i])
+			}
+		}
+		// Odd sizes are halved with partial pixels weighted by area, so the last
+		// level is still the linear average of the base level.
+		got := levels[len(levels)-1].RGBAAt(0, 0)
+		var sum [3]float64
+		base := levels[0]
+		for i := 0; i < len(base.Pix); i += 4 {
+			for c := 0; c < 3; c++ {
+				sum[c] += Linearize(base.Pix[i+c])
+			}
+		}
+		n := float64(tt.w * tt.h)
+		want := color.RGBA{R: Delinearize(sum[0] / n), G: Delinearize(sum[1] / n), B: Delinearize(sum[2] / n), A: 255}
+		if absInt(int(got.R)-int(want.R)) > 1 || absInt(int(got.G)-int(want.G)) > 1 || absInt(int(got.B)-int(want.B)) > 1 || got.A != 255 {
+			t.Errorf("DecodeMipmaps(%dx%d) 1x1 level = %v, want close to the average %v", tt.w, tt.h, got, want)
+		}
+	}
+	// Over a large base the decode averages to the DC color of the hash.
+	levels, err := DecodeMipmaps(hash, 640, 480)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := levels[len(levels)-1].RGBAAt(0, 0); absInt(int(got.R)-int(avg.R)) > 1 || absInt(int(got.G)-int(avg.G)) > 1 || absInt(int(got.B)-int(avg.B)) > 1 {
+		t.Errorf("DecodeMipmaps(640x480) 1x1 level = %v, want close to the average color %v", got, avg)
+	}
+	if _, err := DecodeMipmaps(hash, 0, 8); err == nil {
+		t.Error("DecodeMipmaps with zero width succeeded, want error")
+	}
+	if _, err := DecodeMipmaps("invalid", 8, 8); err == nil {
+		t.Error("DecodeMipmaps of an invalid hash succeeded, want error")
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright 2021-2022 Nao Yonashiro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blurhash
+
+import (
+	"fmt"
+	"image"
+	"sync"
+)
+
+// Encoder encodes images reusing its output buffer between calls.
+// An Encoder is not safe for concurrent use; see GetEncoder for a shared pool.
+type Encoder struct {
+	buf []byte
+}
+
+// Encode is like EncodeChecked but appends into the buffer of e.
+func (e *Encoder) Encode(img image.Image, w, h int, opts ...EncodeOption) (string, error) {
+	cfg := newEncodeConfig(opts)
+	if err := checkEncode(img, w, h, cfg); err != nil {
+		return "", err
+	}
+	if err := checkImageSize(img, w, h, cfg); err != nil {
+		return "", err
+	}
+	e.buf, _ = appendImage(e.buf[:0], img, w, h, cfg)
+	return string(e.buf), nil
+}
+
+var encoderPool = sync.Pool{
+	New: func() interface{} {
+		return &Encoder{buf: make([]byte, 0, EncodedLen(9, 9))}
+	},
+}
+
+// GetEncoder borrows an Encoder from a package-wide pool. It is safe to call from
+// multiple goroutines. The Encoder must be returned with PutEncoder once done,
+// and must not be used after it has been returned.
+func GetEncoder() *Encoder {
+	return encoderPool.Get().(*Encoder)
+}
+
+// PutEncoder returns an Encoder borrowed with GetEncoder to the pool.
+func PutEncoder(e *Encoder) {
+	encoderPool.Put(e)
+}
+
+// Cosines holds the basis of the encoder for one image size and component grid.
+// Callers encoding many images of the same size can build it once with
+// PrecomputeCosines and pass it to AppendWithCosines, which then reuses the basis
+// instead of evaluating it for every image. A Cosines is safe for concurrent use.
+type Cosines struct {
+	imgW, imgH, w, h int
+	x, y             []float64
+}
+
+// PrecomputeCosines returns the basis for encoding imgW x imgH images with w x h components.
+// It panics if w or h is not in range 1..9, like Append.
+func PrecomputeCosines(imgW, imgH, w, h int) *Cosines {
+	if !validComponents(w, h) {
+		panic(ErrInvalidComponents)
+	}
+	return &Cosines{
+		imgW: imgW,
+		imgH: imgH,
+		w:    w,
+		h:    h,
+		x:    cosTable(nil, imgW, w),
+		y:    cosTable(nil, imgH, h),
+	}
+}
+
+// AppendWithCosines is like Append with the components of c, but reuses its basis.
+// It produces the same hash as Append. It panics if the size of img differs from
+// the size c was built for.
+func AppendWithCosines(dst []byte, img image.Image, c *Cosines) []byte {
+	if b := img.Bounds(); b.Dx() != c.imgW || b.Dy() != c.imgH {
+		panic(fmt.Sprintf("blurhash: image size %dx%d does not match cosines for %dx%d", b.Dx(), b.Dy(), c.imgW, c.imgH))
+	}
+	cfg := newEncodeConfig(nil)
+	cfg.cosines = c
+	dst, _ = appendImage(dst, img, c.w, c.h, cfg)
+	return dst
+}
+
+// Scratch holds the memory Append needs beyond its output: the basis tables for
+// the last image size and the pixel accessor for the last image. Passing the same
+// Scratch to AppendScratch for every call of a tight loop keeps the encoder from
+// allocating, as long as the image is the same value each time, e.g. a frame
+// buffer that is refilled. Images without a fast accessor, such as *image.RGBA,
+// are read through At, which still allocates for every pixel.
+// The zero value is ready to use.
+// A Scratch is not safe for concurrent use.
+type Scratch struct {
+	cos Cosines
+
+	img  image.Image
+	at   func(x, y int) (r, b, g, a uint32)
+	fast bool // whether img and at are set
+}
+
+// AppendScratch is like Append with default options, but keeps its working memory
+// in s between calls. A nil s allocates like Append. It produces the same hash as
+// Append and panics under the same conditions.
+func AppendScratch(dst []byte, img image.Image, w, h int, s *Scratch) []byte {
+	if s == nil {
+		return Append(dst, img, w, h)
+	}
+	cfg := defaultEncodeConfig()
+	if err := checkEncode(img, w, h, cfg); err != nil {
+		panic(err)
+	}
+	if _, ok := img.(*image.Uniform); !ok {
+		b := img.Bounds()
+		cfg.cosines = s.cosines(b.Dx(), b.Dy(), w, h)
+	}
+	cfg.scratch = s
+	dst, _ = appendImage(dst, img, w, h, cfg)
+	return dst
+}
+
+// cosines returns the basis for imgW x imgH images with w x h components,
+// rebuilding it in place if the size differs from the previous call.
+func (s *Scratch) cosines(imgW, imgH, w, h int) *Cosines {
+	c := &s.cos
+	if c.x == nil || c.imgW != imgW || c.imgH != imgH || c.w != w || c.h != h {
+		c.imgW, c.imgH, c.w, c.h = imgW, imgH, w, h
+		c.x = cosTable(c.x, imgW, w)
+		c.y = cosTable(c.y, imgH, h)
+	}
+	return c
+}
+
+// accessor is like fastAccessor but reuses the accessor of the previous call if
+// img is the same value. Only the fast accessors are kept; they are built for
+// pointer types, so comparing img to them cannot panic.
+func (s *Scratch) accessor(img image.Image) (func(x, y int) (r, b, g, a uint32), bool) {
+	if s.fast && s.img == img {
+		return s.at, true
+	}
+	at, fast := fastAccessor(img)
+	if fast {
+		s.img, s.at, s.fast = img, at, true
+	}
+	return at, fast
+}
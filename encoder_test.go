@@ -0,0 +1,147 @@
+// Copyright 2021-2022 Nao Yonashiro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blurhash
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"sync"
+	"testing"
+)
+
+func TestEncoderPool(t *testing.T) {
+	imgs := []image.Image{detailImage(32, 24), gradientImage(40, 30), readPNG(t, "photo.png")}
+	want := make([]string, len(imgs))
+	for i, img := range imgs {
+		want[i] = Encode(img, 4, 3)
+	}
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for n := 0; n < 20; n++ {
+				i := (g + n) % len(imgs)
+				e := GetEncoder()
+				got, err := e.Encode(imgs[i], 4, 3)
+				PutEncoder(e)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if got != want[i] {
+					t.Errorf("goroutine %d: got %q, want %q", g, got, want[i])
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+}
+
+func TestAppendWithCosines(t *testing.T) {
+	imgs := []image.Image{
+		detailImage(32, 24),
+		gradientImage(32, 24),
+		detailImage(40, 40).SubImage(image.Rect(5, 9, 37, 33)),
+		genericImage{detailImage(32, 24)},
+	}
+	for _, grid := range []image.Point{{1, 1}, {4, 3}, {9, 9}, {2, 7}} {
+		// One table is reused for every image of the same size.
+		c := PrecomputeCosines(32, 24, grid.X, grid.Y)
+		for i, img := range imgs {
+			want := string(Append(nil, img, grid.X, grid.Y))
+			if got := string(AppendWithCosines(nil, img, c)); got != want {
+				t.Errorf("image %d at %v: AppendWithCosines = %q, want %q", i, grid, got, want)
+			}
+		}
+	}
+	mustPanic := func(name string, fn func()) {
+		t.Helper()
+		defer func() {
+			if recover() == nil {
+				t.Errorf("%s did not panic", name)
+			}
+		}()
+		fn()
+	}
+	c := PrecomputeCosines(32, 24, 4, 3)
+	mustPanic("AppendWithCosines with a wider image", func() { AppendWithCosines(nil, detailImage(33, 24), c) })
+	mustPanic("AppendWithCosines with a taller image", func() { AppendWithCosines(nil, detailImage(32, 25), c) })
+	mustPanic("PrecomputeCosines with 10 components", func() { PrecomputeCosines(32, 24, 10, 3) })
+	mustPanic("PrecomputeCosines with 0 components", func() { PrecomputeCosines(32, 24, 4, 0) })
+}
+
+func TestAppendScratch(t *testing.T) {
+	imgs := []image.Image{
+		accessorImage("NRGBA", 32, 24),
+		accessorImage("YCbCr", 32, 24),
+		accessorImage("Gray", 32, 24),
+		accessorImage("Alpha", 32, 24),
+		accessorImage("generic", 32, 24),
+		detailImage(40, 40).SubImage(image.Rect(3, 5, 35, 29)),
+		gradientImage(17, 9),
+		image.NewUniform(color.RGBA{R: 0x40, G: 0x80, B: 0xc0, A: 0xff}),
+	}
+	// One Scratch is reused across image types, sizes and grids.
+	var s Scratch
+	for _, grid := range []image.Point{{4, 3}, {1, 1}, {9, 9}, {4, 3}} {
+		for i, img := range imgs {
+			want := string(Append(nil, img, grid.X, grid.Y))
+			if got := string(AppendScratch(nil, img, grid.X, grid.Y, &s)); got != want {
+				t.Errorf("image %d at %v: AppendScratch = %q, want %q", i, grid, got, want)
+			}
+			if got := string(AppendScratch(nil, img, grid.X, grid.Y, nil)); got != want {
+				t.Errorf("image %d at %v: AppendScratch with nil Scratch = %q, want %q", i, grid, got, want)
+			}
+		}
+	}
+	// Refilling the same image between calls is picked up.
+	img := detailImage(32, 24)
+	AppendScratch(nil, img, 4, 3, &s)
+	draw.Draw(img, img.Rect, gradientImage(32, 24), image.Point{}, draw.Src)
+	if got, want := string(AppendScratch(nil, img, 4, 3, &s)), Encode(img, 4, 3); got != want {
+		t.Errorf("AppendScratch after refilling the image = %q, want %q", got, want)
+	}
+
+	dst := make([]byte, 0, EncodedLen(9, 9))
+	for _, kind := range []string{"NRGBA", "YCbCr", "Gray", "Gray16", "Alpha", "Alpha16"} {
+		img := accessorImage(kind, 32, 24)
+		if n := testing.AllocsPerRun(10, func() { dst = AppendScratch(dst[:0], img, 4, 3, &s) }); n != 0 {
+			t.Errorf("AppendScratch of %s with a reused Scratch makes %v allocations, want 0", kind, n)
+		}
+	}
+}
+
+func BenchmarkAppendScratch(b *testing.B) {
+	img := accessorImage("NRGBA", 256, 192)
+	dst := make([]byte, 0, EncodedLen(4, 3))
+	b.Run("Append", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			dst = Append(dst[:0], img, 4, 3)
+		}
+	})
+	b.Run("Scratch", func(b *testing.B) {
+		var s Scratch
+		AppendScratch(nil, img, 4, 3, &s)
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			dst = AppendScratch(dst[:0], img, 4, 3, &s)
+		}
+	})
+}
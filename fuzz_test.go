@@ -0,0 +1,49 @@
+// Copyright 2021-2022 Nao Yonashiro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build go1.18
+// +build go1.18
+
+package blurhash
+
+import (
+	"testing"
+)
+
+func FuzzDecode(f *testing.F) {
+	for _, hash := range []string{
+		"",
+		"000000",
+		"LEHV6nWB2yk8pyo0adR*.7kCMdnj",
+		"LEHV6nWB2yépyo0adR*.7kCMdnj",
+		"~EHV6nWB2yk8pyo0adR*.7kCMdnj",
+	} {
+		f.Add(hash)
+	}
+	f.Fuzz(func(t *testing.T, hash string) {
+		validErr := Validate(hash)
+		_, parseErr := Parse(hash)
+		img, err := Decode(hash, 4, 3)
+		if (validErr == nil) != (parseErr == nil) || (validErr == nil) != (err == nil) {
+			t.Fatalf("Validate: %v, Parse: %v, Decode: %v, want all nil or all errors", validErr, parseErr, err)
+		}
+		if err == nil && img.Bounds().Dx() != 4 {
+			t.Fatalf("Decode(%q, 4, 3) has bounds %v", hash, img.Bounds())
+		}
+		DecodeAverageColor(hash)
+		Components(hash)
+		Inspect(hash)
+		DecodeCompact(hash, 4, 3)
+	})
+}
@@ -0,0 +1,325 @@
+// Copyright 2021-2022 Nao Yonashiro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blurhash
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"strings"
+)
+
+// SignificantComponents returns the number of AC components of hash whose
+// largest channel magnitude, relative to the maximum AC value of the hash, exceeds threshold.
+func SignificantComponents(hash string, threshold float64) (int, error) {
+	parsed, err := Parse(hash)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, f := range parsed.factors[1:] {
+		if f.absMax()/parsed.max > threshold {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// IsGrayscale reports whether the red, green and blue channels of every
+// component of hash are equal within tolerance, in linear space.
+func IsGrayscale(hash string, tolerance float64) (bool, error) {
+	parsed, err := Parse(hash)
+	if err != nil {
+		return false, err
+	}
+	for _, f := range parsed.factors {
+		if math.Abs(f.r-f.g) > tolerance || math.Abs(f.g-f.b) > tolerance || math.Abs(f.b-f.r) > tolerance {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// IsFlat reports whether every AC component of hash is within tolerance of zero,
+// in linear space, meaning that hash decodes to an almost solid color.
+func IsFlat(hash string, tolerance float64) (bool, error) {
+	parsed, err := Parse(hash)
+	if err != nil {
+		return false, err
+	}
+	for _, f := range parsed.factors[1:] {
+		if f.absMax() > tolerance {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// Complexity returns a score in range 0..1 estimating how much detail hash carries.
+// It is 1-exp(-4·E), where E is the sum over the AC components of their mean
+// absolute channel value in linear space, so both more components and stronger
+// components increase the score. A flat hash scores near 0.
+func Complexity(hash string) (float64, error) {
+	parsed, err := Parse(hash)
+	if err != nil {
+		return 0, err
+	}
+	var energy float64
+	for _, f := range parsed.factors[1:] {
+		energy += (math.Abs(f.r) + math.Abs(f.g) + math.Abs(f.b)) / 3
+	}
+	return 1 - math.Exp(-4*energy), nil
+}
+
+// BandingRisk estimates how likely visible banding is when hash is decoded to
+// width x height with 8 bits per channel, as a score in range 0..1, without decoding it.
+// For each channel it estimates the number of sRGB levels L spanned by the image as
+// the sum over the AC components of 2·|value| times the slope of the sRGB curve at
+// the DC value. The bands are then about B = max(width, height)/L pixels wide, and
+// the score is 1-exp(-B/8). It is 0 when L is below half a level, as a flat image
+// has no bands. A high score suggests enabling WithDither.
+func BandingRisk(hash string, width, height int) (float64, error) {
+	if err := checkSize(width, height); err != nil {
+		return 0, err
+	}
+	parsed, err := Parse(hash)
+	if err != nil {
+		return 0, err
+	}
+	var span factor
+	for _, f := range parsed.factors[1:] {
+		span.r += 2 * math.Abs(f.r)
+		span.g += 2 * math.Abs(f.g)
+		span.b += 2 * math.Abs(f.b)
+	}
+	dc := parsed.factors[0]
+	levels := math.Max(span.r*sRGBSlope(dc.r), math.Max(span.g*sRGBSlope(dc.g), span.b*sRGBSlope(dc.b)))
+	if levels < 0.5 {
+		return 0, nil
+	}
+	band := float64(maxInt(width, height)) / levels
+	return 1 - math.Exp(-band/8), nil
+}
+
+// GradientDirection estimates the overall direction in which hash gets lighter from
+// the luma of its first horizontal and vertical AC components. angle is in radians
+// from the +x axis towards +y, which points down as in image coordinates, so 0 means
+// lighter to the right and π/2 lighter towards the bottom. strength is the length
+// of the gradient in linear luma, 0 for a flat hash.
+func GradientDirection(hash string) (angle, strength float64, err error) {
+	parsed, err := Parse(hash)
+	if err != nil {
+		return 0, 0, err
+	}
+	luma := func(f factor) float64 {
+		return 0.2126*f.r + 0.7152*f.g + 0.0722*f.b
+	}
+	// cos(π·x/width) decreases along the axis, so a positive component means
+	// the image is lighter at the start of the axis.
+	var gx, gy float64
+	if parsed.numX > 1 {
+		gx = -luma(parsed.factors[1])
+	}
+	if parsed.numY > 1 {
+		gy = -luma(parsed.factors[parsed.numX])
+	}
+	return math.Atan2(gy, gx), math.Hypot(gx, gy), nil
+}
+
+// Luminance returns the relative luminance of the average color of hash in range 0..1,
+// computed with the Rec. 709 coefficients in linear space as in WCAG contrast ratios.
+func Luminance(hash string) (float64, error) {
+	c, err := DecodeAverageColor(hash)
+	if err != nil {
+		return 0, err
+	}
+	return 0.2126*sRGB(c.R).linear() + 0.7152*sRGB(c.G).linear() + 0.0722*sRGB(c.B).linear(), nil
+}
+
+// QuadrantColors returns the average colors of the top-left, top-right, bottom-left
+// and bottom-right quarters of the image represented by hash, averaged in linear light.
+// They are computed from the components without decoding the image, using the
+// mean of each basis function over half of its axis.
+func QuadrantColors(hash string) (tl, tr, bl, br color.RGBA, err error) {
+	parsed, err := Parse(hash)
+	if err != nil {
+		return tl, tr, bl, br, err
+	}
+	// The mean of cos(π·i·t) over t in [0, 1/2] is 2·sin(π·i/2)/(π·i), and its
+	// mean over [1/2, 1] is the negation of that.
+	halfMean := func(i int) float64 {
+		if i == 0 {
+			return 1
+		}
+		return 2 * math.Sin(math.Pi*float64(i)/2) / (math.Pi * float64(i))
+	}
+	quadrant := func(right, bottom bool) color.RGBA {
+		var c factor
+		for j := 0; j < parsed.numY; j++ {
+			my := halfMean(j)
+			if bottom && j > 0 {
+				my = -my
+			}
+			for i := 0; i < parsed.numX; i++ {
+				mx := halfMean(i)
+				if right && i > 0 {
+					mx = -mx
+				}
+				f := parsed.factors[j*parsed.numX+i]
+				f.Scale(mx * my)
+				c.r += f.r
+				c.g += f.g
+				c.b += f.b
+			}
+		}
+		return color.RGBA{R: linear(c.r).sRGB(), G: linear(c.g).sRGB(), B: linear(c.b).sRGB(), A: 0xff}
+	}
+	return quadrant(false, false), quadrant(true, false), quadrant(false, true), quadrant(true, true), nil
+}
+
+// sRGBSlope returns the derivative of the 8-bit sRGB encoding at the linear value v.
+func sRGBSlope(v float64) float64 {
+	if v <= 0.0031308 {
+		return 255 * 12.92
+	}
+	return 255 * 1.055 / 2.4 * math.Pow(v, 1/2.4-1)
+}
+
+// ColorResolution returns the number of quantisation levels per channel of the
+// DC and AC components of hash. They are fixed by the format, 256 and 19.
+func ColorResolution(hash string) (dcLevels, acLevels int, err error) {
+	if _, err := Parse(hash); err != nil {
+		return 0, 0, err
+	}
+	return 256, 19, nil
+}
+
+// ExpectComponents returns an error if hash is invalid or does not have
+// wantX x wantY components.
+func ExpectComponents(hash string, wantX, wantY int) error {
+	x, y, err := Components(hash)
+	if err != nil {
+		return err
+	}
+	if x != wantX || y != wantY {
+		return fmt.Errorf("blurhash: hash has %dx%d components, want %dx%d", x, y, wantX, wantY)
+	}
+	return nil
+}
+
+// SameComponents reports whether hashes a and b have the same component grid,
+// which operations combining two hashes component by component require.
+func SameComponents(a, b string) (bool, error) {
+	ax, ay, err := Components(a)
+	if err != nil {
+		return false, err
+	}
+	bx, by, err := Components(b)
+	if err != nil {
+		return false, err
+	}
+	return ax == bx && ay == by, nil
+}
+
+// ShapeInfo describes the header of a blurhash.
+type ShapeInfo struct {
+	// X and Y are the number of horizontal and vertical components.
+	X, Y int
+	// MaxValue is the quantised maximum AC value, in range 0..82.
+	MaxValue int
+}
+
+// Shape parses the component counts and quantised maximum AC value of hash
+// without decoding the DC and AC components.
+func Shape(hash string) (ShapeInfo, error) {
+	x, y, err := Components(hash)
+	if err != nil {
+		return ShapeInfo{}, err
+	}
+	max, err := readBase83(hash, 1, 1)
+	if err != nil {
+		return ShapeInfo{}, err
+	}
+	return ShapeInfo{X: x, Y: y, MaxValue: max}, nil
+}
+
+// Matches reports whether img encodes to a hash equivalent to hash: it is encoded
+// with the component grid of hash, and every dequantised component of the two
+// hashes must be within tolerance, in linear space.
+func Matches(hash string, img image.Image, tolerance float64) (bool, error) {
+	want, err := Parse(hash)
+	if err != nil {
+		return false, err
+	}
+	got, err := Parse(Encode(img, want.numX, want.numY))
+	if err != nil {
+		return false, err
+	}
+	for i, f := range want.factors {
+		g := got.factors[i]
+		if math.Abs(f.r-g.r) > tolerance || math.Abs(f.g-g.g) > tolerance || math.Abs(f.b-g.b) > tolerance {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// DecodedHash is the content of a blurhash.
+type DecodedHash struct {
+	// X and Y are the number of horizontal and vertical components.
+	X, Y int
+	// DC is the average color.
+	DC color.RGBA
+	// Max is the dequantised maximum AC value.
+	Max float64
+	// AC holds the linear red, green and blue values of the AC components, row by row.
+	AC [][3]float64
+}
+
+// Inspect decodes the content of hash.
+func Inspect(hash string) (DecodedHash, error) {
+	parsed, err := Parse(hash)
+	if err != nil {
+		return DecodedHash{}, err
+	}
+	d := DecodedHash{
+		X:   parsed.numX,
+		Y:   parsed.numY,
+		DC:  dcColor(parsed.factors[0]),
+		Max: parsed.max,
+		AC:  make([][3]float64, len(parsed.factors)-1),
+	}
+	for i, f := range parsed.factors[1:] {
+		d.AC[i] = [3]float64{f.r, f.g, f.b}
+	}
+	return d, nil
+}
+
+// String returns a multi-line dump of d with one line per AC component,
+// labelled with its x,y index. For "LEHV6nWB2yk8pyo0adR*.7kCMdnj" it starts with:
+//
+//	4x3 components, max 0.0904
+//	DC #979695
+//	AC 1,0 -0.0045 -0.0045 -0.0045
+func (d DecodedHash) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%dx%d components, max %.4f\n", d.X, d.Y, d.Max)
+	fmt.Fprintf(&sb, "DC #%02x%02x%02x", d.DC.R, d.DC.G, d.DC.B)
+	for i, ac := range d.AC {
+		fmt.Fprintf(&sb, "\nAC %d,%d %+.4f %+.4f %+.4f", (i+1)%d.X, (i+1)/d.X, ac[0], ac[1], ac[2])
+	}
+	return sb.String()
+}
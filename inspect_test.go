@@ -0,0 +1,511 @@
+// Copyright 2021-2022 Nao Yonashiro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blurhash
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"testing"
+)
+
+func TestSignificantComponents(t *testing.T) {
+	tests := []struct {
+		name string
+		hash string
+		min  int
+		max  int
+	}{
+		{"EncodeColor", EncodeColor(color.RGBA{R: 0x40, G: 0x80, B: 0xc0, A: 0xff}, 4, 3), 0, 0},
+		{"solid", Encode(image.NewUniform(color.Gray{Y: 0x80}), 4, 3), 0, 0},
+		{"detailed", Encode(detailImage(64, 48), 4, 3), 8, 11},
+		{"detailed 9x9", Encode(detailImage(64, 48), 9, 9), 20, 80},
+	}
+	for _, tt := range tests {
+		n, err := SignificantComponents(tt.hash, 0.1)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if n < tt.min || n > tt.max {
+			t.Errorf("%s: SignificantComponents(%q, 0.1) = %d, want %d..%d", tt.name, tt.hash, n, tt.min, tt.max)
+		}
+	}
+	if _, err := SignificantComponents("invalid", 0.1); err == nil {
+		t.Error("SignificantComponents of an invalid hash succeeded, want error")
+	}
+}
+
+func TestIsGrayscale(t *testing.T) {
+	gray := image.NewGray(image.Rect(0, 0, 64, 48))
+	for i := range gray.Pix {
+		gray.Pix[i] = uint8(i % 64 * 4)
+	}
+	tests := []struct {
+		name string
+		hash string
+		want bool
+	}{
+		{"gray", Encode(gray, 4, 3), true},
+		{"gray RGBA", Encode(grayToRGBA(gray), 4, 3), true},
+		{"color", Encode(detailImage(64, 48), 4, 3), false},
+		{"gradient", Encode(gradientImage(64, 48), 4, 3), false},
+	}
+	for _, tt := range tests {
+		got, err := IsGrayscale(tt.hash, 1e-9)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: IsGrayscale(%q) = %v, want %v", tt.name, tt.hash, got, tt.want)
+		}
+	}
+	if _, err := IsGrayscale("invalid", 0); err == nil {
+		t.Error("IsGrayscale of an invalid hash succeeded, want error")
+	}
+}
+
+// grayToRGBA returns img converted to *image.RGBA.
+func grayToRGBA(img *image.Gray) *image.RGBA {
+	rgba := image.NewRGBA(img.Bounds())
+	draw.Draw(rgba, rgba.Rect, img, img.Rect.Min, draw.Src)
+	return rgba
+}
+
+func TestShape(t *testing.T) {
+	tests := []struct {
+		hash string
+		want ShapeInfo
+	}{
+		{"LEHV6nWB2yk8pyo0adR*.7kCMdnj", ShapeInfo{X: 4, Y: 3, MaxValue: 14}},
+		{"LGF5]+Yk^6#M@-5c,1J5@[or[Q6.", ShapeInfo{X: 4, Y: 3, MaxValue: 16}},
+		{"L6PZfSi_.AyE_3t7t7R**0o#DgR4", ShapeInfo{X: 4, Y: 3, MaxValue: 6}},
+		{"LKO2?U%2Tw=w]~RBVZRi};RPxuwH", ShapeInfo{X: 4, Y: 3, MaxValue: 20}},
+		{"00TI:j", ShapeInfo{X: 1, Y: 1, MaxValue: 0}},
+		{EncodeColor(color.Gray{Y: 0x80}, 9, 2), ShapeInfo{X: 9, Y: 2, MaxValue: 0}},
+	}
+	for _, tt := range tests {
+		got, err := Shape(tt.hash)
+		if err != nil {
+			t.Errorf("Shape(%q): %v", tt.hash, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("Shape(%q) = %+v, want %+v", tt.hash, got, tt.want)
+		}
+	}
+	for _, hash := range []string{"", "L", "LEHV6nWB2yk8pyo0adR*.7kCMdn", "LEHV6nWB2yk8pyo0adR*.7kCMdnjj"} {
+		if _, err := Shape(hash); err == nil {
+			t.Errorf("Shape(%q) succeeded, want error", hash)
+		}
+	}
+}
+
+func TestIsFlat(t *testing.T) {
+	tests := []struct {
+		name string
+		hash string
+		want bool
+	}{
+		{"EncodeColor", EncodeColor(color.RGBA{R: 0x40, G: 0x80, B: 0xc0, A: 0xff}, 4, 3), true},
+		{"1x1", Encode(detailImage(64, 48), 1, 1), true},
+		{"uniform", Encode(image.NewUniform(color.Gray{Y: 0x80}), 9, 9), true},
+		{"detailed", Encode(detailImage(64, 48), 4, 3), false},
+		{"reference", "LEHV6nWB2yk8pyo0adR*.7kCMdnj", false},
+	}
+	for _, tt := range tests {
+		got, err := IsFlat(tt.hash, 0.01)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: IsFlat(%q, 0.01) = %v, want %v", tt.name, tt.hash, got, tt.want)
+		}
+	}
+	if _, err := IsFlat("invalid", 0.01); err == nil {
+		t.Error("IsFlat of an invalid hash succeeded, want error")
+	}
+}
+
+func TestMatches(t *testing.T) {
+	img := gradientImage(64, 48)
+	hash := Encode(img, 4, 3)
+	tests := []struct {
+		name      string
+		img       image.Image
+		tolerance float64
+		want      bool
+	}{
+		{"same", img, 0, true},
+		{"rescaled", gradientImage(128, 96), 0.05, true},
+		{"different", detailImage(64, 48), 0.05, false},
+		{"solid", solidImage(64, 48, color.NRGBA{R: 0x80, G: 0x80, B: 0x80, A: 0xff}), 0.05, false},
+	}
+	for _, tt := range tests {
+		got, err := Matches(hash, tt.img, tt.tolerance)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: Matches(%q, img, %v) = %v, want %v", tt.name, hash, tt.tolerance, got, tt.want)
+		}
+	}
+	if _, err := Matches("invalid", img, 0.05); err == nil {
+		t.Error("Matches of an invalid hash succeeded, want error")
+	}
+}
+
+func TestColorResolution(t *testing.T) {
+	for _, hash := range []string{"LEHV6nWB2yk8pyo0adR*.7kCMdnj", "000000"} {
+		dc, ac, err := ColorResolution(hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dc != 256 || ac != 19 {
+			t.Errorf("ColorResolution(%q) = %d, %d, want 256, 19", hash, dc, ac)
+		}
+	}
+	if _, _, err := ColorResolution("invalid"); err == nil {
+		t.Error("ColorResolution of an invalid hash succeeded, want error")
+	}
+}
+
+func TestExpectComponents(t *testing.T) {
+	tests := []struct {
+		hash         string
+		wantX, wantY int
+		ok           bool
+	}{
+		{"LEHV6nWB2yk8pyo0adR*.7kCMdnj", 4, 3, true},
+		{"LEHV6nWB2yk8pyo0adR*.7kCMdnj", 3, 4, false},
+		{"LEHV6nWB2yk8pyo0adR*.7kCMdnj", 9, 9, false},
+		{"000000", 1, 1, true},
+		{"000000", 4, 3, false},
+		{EncodeColor(color.White, 9, 2), 9, 2, true},
+		{"", 4, 3, false},
+	}
+	for _, tt := range tests {
+		err := ExpectComponents(tt.hash, tt.wantX, tt.wantY)
+		if (err == nil) != tt.ok {
+			t.Errorf("ExpectComponents(%q, %d, %d) = %v, want ok %v", tt.hash, tt.wantX, tt.wantY, err, tt.ok)
+		}
+	}
+}
+
+func TestSameComponents(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"LEHV6nWB2yk8pyo0adR*.7kCMdnj", "LGF5]+Yk^6#M@-5c,1J5@[or[Q6.", true},
+		{"LEHV6nWB2yk8pyo0adR*.7kCMdnj", EncodeColor(color.White, 4, 3), true},
+		{"LEHV6nWB2yk8pyo0adR*.7kCMdnj", EncodeColor(color.White, 3, 4), false},
+		{"LEHV6nWB2yk8pyo0adR*.7kCMdnj", "000000", false},
+		{EncodeColor(color.White, 9, 9), EncodeColor(color.Black, 9, 9), true},
+	}
+	for _, tt := range tests {
+		got, err := SameComponents(tt.a, tt.b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("SameComponents(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+	for _, pair := range [][2]string{{"invalid", "000000"}, {"000000", ""}} {
+		if _, err := SameComponents(pair[0], pair[1]); err == nil {
+			t.Errorf("SameComponents(%q, %q) succeeded, want error", pair[0], pair[1])
+		}
+	}
+}
+
+func TestDecodedHashString(t *testing.T) {
+	d, err := Inspect("LEHV6nWB2yk8pyo0adR*.7kCMdnj")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `4x3 components, max 0.0904
+DC #979695
+AC 1,0 -0.0045 -0.0045 -0.0045
+AC 2,0 -0.0904 +0.0045 +0.0714
+AC 3,0 +0.0011 +0.0045 -0.0045
+AC 0,1 +0.0045 +0.0547 +0.0904
+AC 1,1 +0.0045 +0.0000 -0.0011
+AC 2,1 -0.0011 -0.0045 -0.0100
+AC 3,1 -0.0100 -0.0045 -0.0045
+AC 0,2 +0.0402 +0.0547 +0.0402
+AC 1,2 +0.0011 +0.0045 +0.0045
+AC 2,2 -0.0178 -0.0402 -0.0402
+AC 3,2 +0.0045 -0.0045 -0.0011`
+	if got := d.String(); got != want {
+		t.Errorf("String() =\n%s\nwant\n%s", got, want)
+	}
+	d, err = Inspect("00TSUA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := d.String(), "1x1 components, max 0.0060\nDC #ffffff"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
+
+func TestComplexity(t *testing.T) {
+	tests := []struct {
+		name     string
+		hash     string
+		min, max float64
+	}{
+		{"flat", EncodeColor(color.Gray{Y: 0x80}, 9, 9), 0, 0.01},
+		{"1x1", Encode(detailImage(64, 64), 1, 1), 0, 0.01},
+		{"busy", Encode(detailImage(64, 64), 9, 9), 0.99, 1},
+		{"photo", Encode(readPNG(t, "photo.png"), 9, 9), 0.99, 1},
+	}
+	for _, tt := range tests {
+		got, err := Complexity(tt.hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got < tt.min || got > tt.max {
+			t.Errorf("%s: Complexity(%q) = %v, want in range %v..%v", tt.name, tt.hash, got, tt.min, tt.max)
+		}
+	}
+	// More components of the same image carry more detail.
+	img := gradientImage(64, 64)
+	low, err := Complexity(Encode(img, 2, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	high, err := Complexity(Encode(img, 9, 9))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if low >= high {
+		t.Errorf("Complexity at 2x1 = %v, want below %v at 9x9", low, high)
+	}
+	if _, err := Complexity("invalid"); err == nil {
+		t.Error("Complexity of an invalid hash succeeded, want error")
+	}
+}
+
+func TestBandingRisk(t *testing.T) {
+	// A subtle sky gradient spans few sRGB levels, so every band is wide when
+	// it is decoded large.
+	sky := image.NewNRGBA(image.Rect(0, 0, 64, 48))
+	for y := 0; y < 48; y++ {
+		for x := 0; x < 64; x++ {
+			sky.SetNRGBA(x, y, color.NRGBA{R: 40, G: uint8(60 + y/4), B: uint8(110 + y/3), A: 255})
+		}
+	}
+	smooth := Encode(sky, 4, 3)
+	flat := EncodeColor(color.Gray{Y: 0x80}, 4, 3)
+	tests := []struct {
+		name          string
+		hash          string
+		width, height int
+		min, max      float64
+	}{
+		{"smooth large", smooth, 1920, 1080, 0.9, 1},
+		{"smooth small", smooth, 32, 32, 0, 0.5},
+		{"flat", flat, 1920, 1080, 0, 0},
+		{"busy small", Encode(detailImage(64, 48), 4, 3), 32, 32, 0, 0.1},
+	}
+	for _, tt := range tests {
+		got, err := BandingRisk(tt.hash, tt.width, tt.height)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got < tt.min || got > tt.max {
+			t.Errorf("%s: BandingRisk(%q, %d, %d) = %v, want in range %v..%v", tt.name, tt.hash, tt.width, tt.height, got, tt.min, tt.max)
+		}
+	}
+	// The risk grows with the output size.
+	prev := -1.0
+	for _, size := range []int{32, 320, 1920} {
+		got, err := BandingRisk(smooth, size, size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got <= prev {
+			t.Errorf("BandingRisk at %dpx = %v, want above %v", size, got, prev)
+		}
+		prev = got
+	}
+	for _, tt := range []struct {
+		hash          string
+		width, height int
+	}{
+		{"invalid", 32, 32},
+		{smooth, 0, 32},
+		{smooth, 32, -1},
+		{smooth, 1 << 20, 1 << 20},
+	} {
+		if _, err := BandingRisk(tt.hash, tt.width, tt.height); err == nil {
+			t.Errorf("BandingRisk(%q, %d, %d) succeeded, want error", tt.hash, tt.width, tt.height)
+		}
+	}
+}
+
+func TestGradientDirection(t *testing.T) {
+	// ramp returns a gray image whose value grows by dx per column and dy per row.
+	ramp := func(dx, dy int) image.Image {
+		img := image.NewGray(image.Rect(0, 0, 64, 64))
+		for y := 0; y < 64; y++ {
+			for x := 0; x < 64; x++ {
+				v := 128 + dx*(x-32) + dy*(y-32)
+				img.SetGray(x, y, color.Gray{Y: uint8(v)})
+			}
+		}
+		return img
+	}
+	tests := []struct {
+		name string
+		img  image.Image
+		want float64
+	}{
+		{"right", ramp(3, 0), 0},
+		{"down", ramp(0, 3), math.Pi / 2},
+		{"left", ramp(-3, 0), math.Pi},
+		{"up", ramp(0, -3), -math.Pi / 2},
+		{"down right", ramp(1, 1), math.Pi / 4},
+	}
+	for _, tt := range tests {
+		hash := Encode(tt.img, 4, 3)
+		angle, strength, err := GradientDirection(hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d := math.Remainder(angle-tt.want, 2*math.Pi); math.Abs(d) > 0.05 {
+			t.Errorf("%s: GradientDirection(%q) angle = %v, want %v", tt.name, hash, angle, tt.want)
+		}
+		if strength < 0.05 {
+			t.Errorf("%s: GradientDirection(%q) strength = %v, want a clear gradient", tt.name, hash, strength)
+		}
+	}
+	// A steeper ramp is a stronger gradient.
+	_, weak, _ := GradientDirection(Encode(ramp(1, 0), 4, 3))
+	_, steep, _ := GradientDirection(Encode(ramp(3, 0), 4, 3))
+	if weak >= steep {
+		t.Errorf("strength of a gentle ramp = %v, want below %v of a steep one", weak, steep)
+	}
+	for _, hash := range []string{EncodeColor(color.Gray{Y: 0x80}, 4, 3), Encode(ramp(3, 0), 1, 1)} {
+		if _, strength, err := GradientDirection(hash); err != nil || strength != 0 {
+			t.Errorf("GradientDirection(%q) strength = %v, %v, want 0 for a flat hash", hash, strength, err)
+		}
+	}
+	if _, _, err := GradientDirection("invalid"); err == nil {
+		t.Error("GradientDirection of an invalid hash succeeded, want error")
+	}
+}
+
+func TestQuadrantColors(t *testing.T) {
+	colors := [4]color.NRGBA{
+		{R: 0xff, A: 0xff},
+		{G: 0xff, A: 0xff},
+		{B: 0xff, A: 0xff},
+		{R: 0xff, G: 0xff, B: 0xff, A: 0xff},
+	}
+	img := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			img.SetNRGBA(x, y, colors[y/32*2+x/32])
+		}
+	}
+	hash := Encode(img, 9, 9)
+	tl, tr, bl, br, err := QuadrantColors(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := [4]color.RGBA{tl, tr, bl, br}
+	// Each quadrant matches the linear average of the same quarter of a large
+	// decode, and is dominated by the color of that quarter of the source.
+	dec, err := Decode(hash, 512, 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for q, c := range got {
+		var sum [3]float64
+		for y := q / 2 * 256; y < q/2*256+256; y++ {
+			for x := q % 2 * 256; x < q%2*256+256; x++ {
+				p := dec.RGBAAt(x, y)
+				sum[0] += Linearize(p.R)
+				sum[1] += Linearize(p.G)
+				sum[2] += Linearize(p.B)
+			}
+		}
+		want := color.RGBA{R: Delinearize(sum[0] / 65536), G: Delinearize(sum[1] / 65536), B: Delinearize(sum[2] / 65536), A: 0xff}
+		if absInt(int(c.R)-int(want.R)) > 2 || absInt(int(c.G)-int(want.G)) > 2 || absInt(int(c.B)-int(want.B)) > 2 || c.A != 0xff {
+			t.Errorf("quadrant %d = %v, want close to %v", q, c, want)
+		}
+		// The blur mixes in the neighbouring quarters, so only check that the
+		// color of the source quarter dominates.
+		ch := [3]uint8{c.R, c.G, c.B}
+		if q < 3 {
+			for i := range ch {
+				if i != q && ch[i] >= ch[q] {
+					t.Errorf("quadrant %d = %v, want channel %d to dominate like in %v", q, c, q, colors[q])
+				}
+			}
+		} else if c.R < 0xc0 || c.G < 0xc0 || c.B < 0xc0 {
+			t.Errorf("quadrant %d = %v, want close to white", q, c)
+		}
+	}
+	// A flat hash has the same color in every quadrant.
+	flat := EncodeColor(color.RGBA{R: 0x30, G: 0x60, B: 0x90, A: 0xff}, 4, 3)
+	avg, _ := DecodeAverageColor(flat)
+	tl, tr, bl, br, err = QuadrantColors(flat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for q, c := range []color.RGBA{tl, tr, bl, br} {
+		if c != avg {
+			t.Errorf("quadrant %d of a flat hash = %v, want %v", q, c, avg)
+		}
+	}
+	if _, _, _, _, err := QuadrantColors("invalid"); err == nil {
+		t.Error("QuadrantColors of an invalid hash succeeded, want error")
+	}
+}
+
+func TestLuminance(t *testing.T) {
+	tests := []struct {
+		name string
+		c    color.Color
+		want float64
+	}{
+		{"red", color.RGBA{R: 0xff, A: 0xff}, 0.2126},
+		{"green", color.RGBA{G: 0xff, A: 0xff}, 0.7152},
+		{"blue", color.RGBA{B: 0xff, A: 0xff}, 0.0722},
+		{"white", color.White, 1},
+		{"black", color.Black, 0},
+		{"gray", color.Gray{Y: 0x80}, Linearize(0x80)},
+	}
+	for _, tt := range tests {
+		hash := EncodeColor(tt.c, 4, 3)
+		got, err := Luminance(hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("%s: Luminance(%q) = %v, want %v", tt.name, hash, got, tt.want)
+		}
+	}
+	if _, err := Luminance("invalid"); err == nil {
+		t.Error("Luminance of an invalid hash succeeded, want error")
+	}
+}
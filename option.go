@@ -0,0 +1,340 @@
+// Copyright 2021-2022 Nao Yonashiro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blurhash
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"strings"
+	"unicode"
+)
+
+// EncodeOption configures Append and Encode.
+type EncodeOption func(*encodeConfig)
+
+type encodeConfig struct {
+	progress func(done, total int)
+	rounding Rounding
+	toneMap  func(r, g, b float64) (float64, float64, float64)
+
+	focalRect   image.Rectangle
+	focalWeight float64
+
+	minMax       float64
+	sampleStride int
+	strict       bool
+	transpose    bool
+	chromaScale  float64
+
+	background    color.Color
+	bgR, bgG, bgB uint32
+
+	slowPathHook func(modelName string)
+
+	// maxX and maxY limit the components per axis; 0 means no limit.
+	maxX, maxY int
+
+	// compact selects the format of EncodeCompact.
+	compact bool
+	// gray is set when every pixel has equal channels, so only one is accumulated.
+	gray bool
+	// cosines holds precomputed basis tables; nil builds them for each call.
+	cosines *Cosines
+	// scratch caches the pixel accessor between calls of AppendScratch.
+	scratch *Scratch
+}
+
+// defaultEncodeConfig returns the configuration used when no option is given.
+func defaultEncodeConfig() encodeConfig {
+	return encodeConfig{chromaScale: 1, sampleStride: 1}
+}
+
+func newEncodeConfig(opts []EncodeOption) encodeConfig {
+	c := defaultEncodeConfig()
+	for _, opt := range opts {
+		opt(&c)
+	}
+	if c.sampleStride < 1 {
+		c.sampleStride = 1
+	}
+	if c.chromaScale < 0 {
+		c.chromaScale = 0
+	}
+	if c.background != nil {
+		c.bgR, c.bgG, c.bgB, _ = c.background.RGBA()
+	}
+	return c
+}
+
+// WithProgress sets a callback invoked after each row of the source image is processed.
+// done is the number of rows processed so far and total is the image height.
+// The callback is never called concurrently.
+func WithProgress(fn func(done, total int)) EncodeOption {
+	return func(c *encodeConfig) {
+		c.progress = fn
+	}
+}
+
+// WithToneMap sets a function applied to the linear color of every pixel before
+// it is encoded, e.g. to compress the range of HDR sources. The default is the identity.
+func WithToneMap(fn func(r, g, b float64) (float64, float64, float64)) EncodeOption {
+	return func(c *encodeConfig) {
+		c.toneMap = fn
+	}
+}
+
+// WithFocalWeight multiplies the contribution of the pixels within rect, in the
+// coordinate space of the image, by weight, so that the hash better represents that
+// region. The result is a standard hash that any decoder can read.
+func WithFocalWeight(rect image.Rectangle, weight float64) EncodeOption {
+	return func(c *encodeConfig) {
+		c.focalRect = rect
+		c.focalWeight = weight
+	}
+}
+
+// WithMinMax sets a lower bound for the maximum AC value stored in the hash.
+// The maximum is stored in the hash, so any decoder reads the result correctly.
+// The default is 0, which stores the actual maximum.
+func WithMinMax(min float64) EncodeOption {
+	return func(c *encodeConfig) {
+		c.minMax = min
+	}
+}
+
+// WithSampleStride makes the encoder read only every n-th pixel along both axes,
+// which trades accuracy for speed. It works well for large, smooth images.
+// The default is 1, which reads every pixel.
+func WithSampleStride(n int) EncodeOption {
+	return func(c *encodeConfig) {
+		c.sampleStride = n
+	}
+}
+
+// WithStrict makes the encoder reject images whose color model is not a standard
+// RGB, gray, YCbCr or CMYK model, such as *image.Alpha, instead of encoding
+// whatever colors they report. An *image.Uniform is checked by the type of its color.
+func WithStrict(strict bool) EncodeOption {
+	return func(c *encodeConfig) {
+		c.strict = strict
+	}
+}
+
+// WithTranspose encodes the image as if it were transposed, swapping its x and y
+// axes, so that w and h apply to the transposed image. The result is a standard
+// hash that decodes to the transposed blur.
+func WithTranspose(transpose bool) EncodeOption {
+	return func(c *encodeConfig) {
+		c.transpose = transpose
+	}
+}
+
+// WithChromaSubsample scales the chroma of the AC components by factor before
+// quantisation, keeping their luma (Rec. 709, in linear space). A factor below 1
+// reduces color detail, which the eye tolerates well, so that the maximum AC
+// value and hence the quantisation step is dominated by luma detail.
+// The default factor 1 leaves the components unchanged; negative values are treated as 0.
+func WithChromaSubsample(factor float64) EncodeOption {
+	return func(c *encodeConfig) {
+		c.chromaScale = factor
+	}
+}
+
+// WithBackground composites img over the opaque color bg before encoding.
+// Without it, translucent pixels are used premultiplied by their alpha, as
+// returned by color.Color.RGBA, so fully transparent pixels count as black
+// whatever their stored color. Compositing is done in sRGB space, like image/draw.
+func WithBackground(bg color.Color) EncodeOption {
+	return func(c *encodeConfig) {
+		c.background = bg
+	}
+}
+
+// composite blends the premultiplied color r, g, b, a over the background, if any.
+func (c *encodeConfig) composite(r, g, b, a uint32) (uint32, uint32, uint32) {
+	if c.background == nil || a == 0xffff {
+		return r, g, b
+	}
+	t := 0xffff - a
+	return r + c.bgR*t/0xffff, g + c.bgG*t/0xffff, b + c.bgB*t/0xffff
+}
+
+// WithSlowPathHook sets a function called once per encode when img has no fast
+// pixel accessor and is read through its generic At method, which is much slower.
+// modelName is the Go type of img, such as "*image.RGBA".
+func WithSlowPathHook(hook func(modelName string)) EncodeOption {
+	return func(c *encodeConfig) {
+		c.slowPathHook = hook
+	}
+}
+
+// WithMaxComponents limits the number of components to maxX horizontally and
+// maxY vertically. A larger w or h passed to the encoder, even one above 9, is
+// reduced to the limit before it is validated, so callers can cap the grid per
+// axis, for example for wide banners. Limits outside range 1..9 are clamped to it.
+func WithMaxComponents(maxX, maxY int) EncodeOption {
+	return func(c *encodeConfig) {
+		c.maxX = int(clamp(1, 9, float64(maxX)))
+		c.maxY = int(clamp(1, 9, float64(maxY)))
+	}
+}
+
+// components returns w and h reduced to the limits set by WithMaxComponents.
+func (c *encodeConfig) components(w, h int) (int, int) {
+	if c.maxX > 0 {
+		w = minInt(w, c.maxX)
+	}
+	if c.maxY > 0 {
+		h = minInt(h, c.maxY)
+	}
+	return w, h
+}
+
+// Rounding selects how values exactly halfway between two quantisation levels are rounded.
+type Rounding int
+
+const (
+	// RoundHalfUp rounds halfway values up. It is the default and matches the reference encoder.
+	RoundHalfUp Rounding = iota
+	// RoundHalfEven rounds halfway values to the nearest even level.
+	RoundHalfEven
+)
+
+// WithRounding sets the rounding used when quantising the DC and AC components.
+func WithRounding(rounding Rounding) EncodeOption {
+	return func(c *encodeConfig) {
+		c.rounding = rounding
+	}
+}
+
+func (rounding Rounding) sRGB(value linear) uint8 {
+	if rounding == RoundHalfEven {
+		return uint8(clamp(0, 255, math.RoundToEven(value.sRGB255())))
+	}
+	return value.sRGB()
+}
+
+// quantAC maps v in range -1..1 to an AC level in range 0..18 before clamping.
+func (rounding Rounding) quantAC(v float64) float64 {
+	if rounding == RoundHalfEven {
+		return math.RoundToEven(v*9 + 9)
+	}
+	return math.Floor(v*9 + 9.5)
+}
+
+// DecodeOption configures Decode.
+type DecodeOption func(*decodeConfig)
+
+type decodeConfig struct {
+	dither             bool
+	punch              float64
+	rangeMin, rangeMax float64
+	maxPixels          int64
+	nearest            func(p color.Palette, c color.Color) int
+	lenient            bool
+}
+
+func newDecodeConfig(opts []DecodeOption) (decodeConfig, error) {
+	c := decodeConfig{
+		punch:     1,
+		rangeMin:  0,
+		rangeMax:  1,
+		maxPixels: DefaultMaxOutputPixels,
+		nearest:   color.Palette.Index,
+	}
+	for _, opt := range opts {
+		opt(&c)
+	}
+	if !(c.punch > 0) {
+		return c, ErrInvalidPunch
+	}
+	if c.nearest == nil {
+		c.nearest = color.Palette.Index
+	}
+	return c, nil
+}
+
+// WithDither enables ordered dithering when converting to 8-bit sRGB,
+// which reduces banding on large outputs. It is disabled by default.
+func WithDither(dither bool) DecodeOption {
+	return func(c *decodeConfig) {
+		c.dither = dither
+	}
+}
+
+// WithPunch scales the AC components to adjust the contrast of the decoded image.
+// The default is 1. Decode returns ErrInvalidPunch if punch is not positive.
+func WithPunch(punch float64) DecodeOption {
+	return func(c *decodeConfig) {
+		c.punch = punch
+	}
+}
+
+// WithRange linearly remaps the reconstructed linear values from 0..1 into min..max
+// before conversion to sRGB, producing a subtler image. The default is 0..1.
+func WithRange(min, max float64) DecodeOption {
+	return func(c *decodeConfig) {
+		c.rangeMin, c.rangeMax = min, max
+	}
+}
+
+// WithMaxOutputPixels sets the largest number of pixels a decoder produces.
+// Larger sizes are rejected before anything is allocated, which protects servers
+// that let clients choose the size. The default is DefaultMaxOutputPixels.
+func WithMaxOutputPixels(n int64) DecodeOption {
+	return func(c *decodeConfig) {
+		c.maxPixels = n
+	}
+}
+
+// WithNearest sets the function DecodePaletted uses to pick the index of the
+// palette entry closest to c, so that a perceptual distance can replace the
+// default color.Palette.Index. A nil function restores the default.
+func WithNearest(nearest func(p color.Palette, c color.Color) int) DecodeOption {
+	return func(c *decodeConfig) {
+		c.nearest = nearest
+	}
+}
+
+// WithLenientWhitespace makes decoders ignore whitespace anywhere in the hash,
+// such as stray spaces or line breaks from copying it. By default any character
+// outside the base83 alphabet is an error. Whitespace is never part of the
+// alphabet, so no valid hash changes meaning, but many distinct strings then
+// decode to the same image: do not enable it where hashes are compared, used as
+// cache keys or signed as strings without normalising them the same way first.
+func WithLenientWhitespace(lenient bool) DecodeOption {
+	return func(c *decodeConfig) {
+		c.lenient = lenient
+	}
+}
+
+// normalize returns hash with whitespace removed if lenient parsing is enabled.
+func (c *decodeConfig) normalize(hash string) string {
+	if !c.lenient {
+		return hash
+	}
+	return strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return -1
+		}
+		return r
+	}, hash)
+}
+
+// parse is like Parse but honours WithLenientWhitespace.
+func (c *decodeConfig) parse(hash string) (*Parsed, error) {
+	return Parse(c.normalize(hash))
+}
@@ -0,0 +1,150 @@
+// Copyright 2021-2022 Nao Yonashiro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blurhash
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"strings"
+)
+
+// placeholderSize is the largest internal resolution used by Placeholder per axis.
+const placeholderSize = 32
+
+// Placeholder returns a width x height blurred placeholder for hash.
+// It is the recommended way to render a hash: it decodes at a small internal
+// resolution and scales up with bilinear interpolation in linear light, which is
+// much cheaper than Decode at large sizes and looks the same. It takes the same
+// options as Decode.
+func Placeholder(hash string, width, height int, opts ...DecodeOption) (*image.RGBA, error) {
+	cfg, err := newDecodeConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.checkSize(width, height); err != nil {
+		return nil, err
+	}
+	parsed, err := cfg.parse(hash)
+	if err != nil {
+		return nil, err
+	}
+	parsed = parsed.punch(cfg.punch)
+
+	iw, ih := minInt(width, placeholderSize), minInt(height, placeholderSize)
+	pix := make([]factor, iw*ih)
+	parsed.render(iw, ih, func(x, y int, c factor) {
+		pix[y*iw+x] = c
+	})
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0, y1, ty := bilinearTaps(y, height, ih)
+		for x := 0; x < width; x++ {
+			x0, x1, tx := bilinearTaps(x, width, iw)
+			top := lerpFactor(pix[y0*iw+x0], pix[y0*iw+x1], tx)
+			bottom := lerpFactor(pix[y1*iw+x0], pix[y1*iw+x1], tx)
+			cfg.store(img.Pix[img.PixOffset(x, y):], x, y, lerpFactor(top, bottom, ty))
+		}
+	}
+	return img, nil
+}
+
+// Preview returns hash decoded at 32x32, the size Placeholder decodes at internally.
+// It is meant to be scaled to the display size by CSS or the GPU, which is
+// indistinguishable from a full-size decode for a blurred image.
+func Preview(hash string) (*image.RGBA, error) {
+	return Decode(hash, placeholderSize, placeholderSize)
+}
+
+// BlendOver fills dst with bg and composites the decoded hash over it with
+// opacity alpha in range 0..1, using the size of dst.Bounds(). It can be used to
+// render the frames of a cross-fade between a solid color and a placeholder.
+func BlendOver(dst draw.Image, hash string, bg color.Color, alpha float64) error {
+	bounds := dst.Bounds()
+	src, err := Decode(hash, bounds.Dx(), bounds.Dy())
+	if err != nil {
+		return err
+	}
+	mask := image.NewUniform(color.Alpha{A: uint8(clamp(0, 255, alpha*255+0.5))})
+	draw.Draw(dst, bounds, image.NewUniform(bg), image.Point{}, draw.Src)
+	draw.DrawMask(dst, bounds, src, image.Point{}, mask, image.Point{}, draw.Over)
+	return nil
+}
+
+// asciiRamp lists characters from darkest to brightest.
+const asciiRamp = " .:-=+*#%@"
+
+// ASCIIPreview renders hash as cols x rows characters, one line per row
+// separated by newlines, choosing brighter characters for brighter pixels.
+// It takes the same options as Decode, except that WithDither has no effect.
+func ASCIIPreview(hash string, cols, rows int, opts ...DecodeOption) (string, error) {
+	cfg, err := newDecodeConfig(opts)
+	if err != nil {
+		return "", err
+	}
+	if err := cfg.checkSize(cols, rows); err != nil {
+		return "", err
+	}
+	parsed, err := cfg.parse(hash)
+	if err != nil {
+		return "", err
+	}
+	parsed = parsed.punch(cfg.punch)
+
+	var sb strings.Builder
+	sb.Grow((cols + 1) * rows)
+	parsed.render(cols, rows, func(x, y int, c factor) {
+		if x == 0 && y > 0 {
+			sb.WriteByte('\n')
+		}
+		c = cfg.applyRange(c)
+		l := linear(0.2126*c.r+0.7152*c.g+0.0722*c.b).sRGB255() / 255
+		sb.WriteByte(asciiRamp[int(l*float64(len(asciiRamp)-1)+0.5)])
+	})
+	return sb.String(), nil
+}
+
+// bilinearTaps maps the output pixel i of n to the two source pixels of m it
+// lies between and the interpolation weight of the second one.
+func bilinearTaps(i, n, m int) (i0, i1 int, t float64) {
+	s := clamp(0, float64(m-1), (float64(i)+0.5)*float64(m)/float64(n)-0.5)
+	i0 = int(s)
+	i1 = minInt(i0+1, m-1)
+	return i0, i1, s - math.Floor(s)
+}
+
+func lerpFactor(a, b factor, t float64) factor {
+	return factor{
+		r: a.r + (b.r-a.r)*t,
+		g: a.g + (b.g-a.g)*t,
+		b: a.b + (b.b-a.b)*t,
+	}
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
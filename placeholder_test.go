@@ -0,0 +1,229 @@
+// Copyright 2021-2022 Nao Yonashiro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blurhash
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"strings"
+	"testing"
+)
+
+// maxStep returns the largest difference of a channel between horizontally or
+// vertically adjacent pixels of img.
+func maxStep(img *image.RGBA) int {
+	step := 0
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			p := img.Pix[img.PixOffset(x, y):][:3]
+			for _, q := range []image.Point{{X: x + 1, Y: y}, {X: x, Y: y + 1}} {
+				if !q.In(b) {
+					continue
+				}
+				n := img.Pix[img.PixOffset(q.X, q.Y):][:3]
+				for c := range p {
+					step = maxInt(step, absInt(int(p[c])-int(n[c])))
+				}
+			}
+		}
+	}
+	return step
+}
+
+func absInt(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+func TestPlaceholder(t *testing.T) {
+	hash := "LEHV6nWB2yk8pyo0adR*.7kCMdnj"
+	for _, size := range [][2]int{{400, 300}, {1000, 40}, {10, 5}, {1, 1}} {
+		w, h := size[0], size[1]
+		img, err := Placeholder(hash, w, h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := img.Bounds(); got != image.Rect(0, 0, w, h) {
+			t.Errorf("Placeholder(%q, %d, %d) has bounds %v", hash, w, h, got)
+			continue
+		}
+		if !img.Opaque() {
+			t.Errorf("Placeholder(%q, %d, %d) is not opaque", hash, w, h)
+		}
+		want, err := Decode(hash, w, h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		diff := 0
+		for i := range img.Pix {
+			diff = maxInt(diff, absInt(int(img.Pix[i])-int(want.Pix[i])))
+		}
+		if diff > 6 {
+			t.Errorf("Placeholder(%q, %d, %d) differs from Decode by up to %d", hash, w, h, diff)
+		}
+		// Upscaling must not add visible steps beyond those of a full decode.
+		if got, limit := maxStep(img), maxStep(want)+1; got > limit {
+			t.Errorf("Placeholder(%q, %d, %d) has steps of %d between pixels, want at most %d", hash, w, h, got, limit)
+		}
+	}
+}
+
+func TestPlaceholderOptions(t *testing.T) {
+	const hash = "LEHV6nWB2yk8pyo0adR*.7kCMdnj"
+	opts := []DecodeOption{WithPunch(2), WithRange(0.2, 0.5), WithDither(true), WithLenientWhitespace(true)}
+	// Up to the internal size no interpolation happens, so the options must act
+	// exactly as they do for Decode.
+	img, err := Placeholder(hash+"\r\n", 20, 15, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := Decode(hash, 20, 15, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(img.Pix, want.Pix) {
+		t.Error("Placeholder with options differs from Decode at 20x15")
+	}
+	if _, err := Placeholder(hash, 400, 300, WithMaxOutputPixels(400*300-1)); err == nil {
+		t.Error("Placeholder above WithMaxOutputPixels succeeded, want error")
+	}
+	if _, err := Placeholder(hash, 400, 300, WithPunch(0)); !errors.Is(err, ErrInvalidPunch) {
+		t.Errorf("Placeholder with WithPunch(0) = %v, want ErrInvalidPunch", err)
+	}
+}
+
+func TestPreview(t *testing.T) {
+	hash := "LEHV6nWB2yk8pyo0adR*.7kCMdnj"
+	img, err := Preview(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := img.Bounds(), image.Rect(0, 0, 32, 32); got != want {
+		t.Fatalf("bounds %v, want %v", got, want)
+	}
+	want, err := Decode(hash, 32, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(img.Pix, want.Pix) {
+		t.Error("Preview differs from Decode at 32x32")
+	}
+	if _, err := Preview("invalid"); err == nil {
+		t.Error("Preview of an invalid hash succeeded, want error")
+	}
+}
+
+func TestASCIIPreview(t *testing.T) {
+	for _, size := range [][2]int{{40, 10}, {1, 1}, {7, 3}} {
+		cols, rows := size[0], size[1]
+		s, err := ASCIIPreview("LEHV6nWB2yk8pyo0adR*.7kCMdnj", cols, rows)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(s, "\n")
+		if len(lines) != rows {
+			t.Errorf("ASCIIPreview(%d, %d) has %d lines, want %d", cols, rows, len(lines), rows)
+		}
+		for i, line := range lines {
+			if len(line) != cols {
+				t.Errorf("ASCIIPreview(%d, %d) line %d is %q, want %d characters", cols, rows, i, line, cols)
+			}
+			if strings.Trim(line, asciiRamp) != "" {
+				t.Errorf("ASCIIPreview(%d, %d) line %d is %q, want only characters of %q", cols, rows, i, line, asciiRamp)
+			}
+		}
+	}
+	white, err := ASCIIPreview(EncodeColor(color.White, 1, 1), 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if white != "@@@\n@@@" {
+		t.Errorf("ASCIIPreview of white = %q, want %q", white, "@@@\n@@@")
+	}
+	if _, err := ASCIIPreview("invalid", 3, 2); err == nil {
+		t.Error("ASCIIPreview of an invalid hash succeeded, want error")
+	}
+}
+
+func TestASCIIPreviewOptions(t *testing.T) {
+	white := EncodeColor(color.White, 1, 1)
+	s, err := ASCIIPreview(white[:3]+" "+white[3:], 3, 2, WithRange(0, 0), WithLenientWhitespace(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != "   \n   " {
+		t.Errorf("ASCIIPreview of white with WithRange(0, 0) = %q, want %q", s, "   \n   ")
+	}
+	const hash = "LEHV6nWB2yk8pyo0adR*.7kCMdnj"
+	plain, err := ASCIIPreview(hash, 40, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	punched, err := ASCIIPreview(hash, 40, 10, WithPunch(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if punched == plain {
+		t.Error("ASCIIPreview with WithPunch(3) is the same as without")
+	}
+	if _, err := ASCIIPreview(hash, 40, 10, WithMaxOutputPixels(399)); err == nil {
+		t.Error("ASCIIPreview above WithMaxOutputPixels succeeded, want error")
+	}
+	if _, err := ASCIIPreview(hash, 40, 10, WithPunch(0)); !errors.Is(err, ErrInvalidPunch) {
+		t.Errorf("ASCIIPreview with WithPunch(0) = %v, want ErrInvalidPunch", err)
+	}
+}
+
+func TestBlendOver(t *testing.T) {
+	hash := "LEHV6nWB2yk8pyo0adR*.7kCMdnj"
+	bg := color.RGBA{R: 0x20, G: 0x40, B: 0x60, A: 0xff}
+	r := image.Rect(5, 5, 45, 35)
+	blur, err := Decode(hash, r.Dx(), r.Dy())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst := image.NewRGBA(r)
+	if err := BlendOver(dst, hash, bg, 0); err != nil {
+		t.Fatal(err)
+	}
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			if got := dst.RGBAAt(x, y); got != bg {
+				t.Fatalf("alpha 0: pixel (%d, %d) = %v, want %v", x, y, got, bg)
+			}
+		}
+	}
+
+	if err := BlendOver(dst, hash, bg, 1); err != nil {
+		t.Fatal(err)
+	}
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			if got, want := dst.RGBAAt(x, y), blur.RGBAAt(x-r.Min.X, y-r.Min.Y); got != want {
+				t.Fatalf("alpha 1: pixel (%d, %d) = %v, want %v", x, y, got, want)
+			}
+		}
+	}
+
+	if err := BlendOver(dst, "invalid", bg, 0.5); err == nil {
+		t.Error("BlendOver of an invalid hash succeeded, want error")
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright 2021-2022 Nao Yonashiro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blurhash
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+)
+
+// DecodePNG decodes hash to a width x height image and writes it to w as a PNG.
+// Rows are decoded one at a time as the PNG encoder consumes them, so it holds
+// one decoded row and the basis tables of both axes, O(width+height), rather than
+// the whole image. image/png reads the pixels through At, which allocates a
+// short-lived color for every pixel, so it is slower than encoding the image
+// returned by Decode with png.Encode.
+func DecodePNG(w io.Writer, hash string, width, height int, opts ...DecodeOption) error {
+	cfg, err := newDecodeConfig(opts)
+	if err != nil {
+		return err
+	}
+	if err := cfg.checkSize(width, height); err != nil {
+		return err
+	}
+	parsed, err := cfg.parse(hash)
+	if err != nil {
+		return err
+	}
+	img := &rowImage{
+		parsed: parsed.punch(cfg.punch),
+		cfg:    &cfg,
+		width:  width,
+		height: height,
+		xCos:   buildCosTable(nil, width),
+		yCos:   buildCosTable(nil, height),
+		row:    make([]byte, width*4),
+		y:      -1,
+	}
+	return png.Encode(w, img)
+}
+
+// rowImage is an opaque image.Image that decodes the row of the last pixel read.
+type rowImage struct {
+	parsed        *Parsed
+	cfg           *decodeConfig
+	width, height int
+	xCos, yCos    []float64
+	row           []byte
+	y             int
+}
+
+func (m *rowImage) ColorModel() color.Model { return color.RGBAModel }
+
+func (m *rowImage) Bounds() image.Rectangle { return image.Rect(0, 0, m.width, m.height) }
+
+// Opaque lets image/png skip scanning every pixel for transparency.
+func (m *rowImage) Opaque() bool { return true }
+
+func (m *rowImage) At(x, y int) color.Color {
+	if !(image.Point{X: x, Y: y}).In(m.Bounds()) {
+		return color.RGBA{}
+	}
+	if y != m.y {
+		m.parsed.renderCos(m.xCos, m.yCos[y*9:], image.Rect(0, y, m.width, y+1), func(x, y int, c factor) {
+			m.cfg.store(m.row[x*4:], x, y, c)
+		})
+		m.y = y
+	}
+	p := m.row[x*4 : x*4+4 : x*4+4]
+	return color.RGBA{R: p[0], G: p[1], B: p[2], A: p[3]}
+}
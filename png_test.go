@@ -0,0 +1,74 @@
+// Copyright 2021-2022 Nao Yonashiro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blurhash
+
+import (
+	"bytes"
+	"errors"
+	"image/png"
+	"testing"
+)
+
+// errWriter fails every write.
+type errWriter struct{}
+
+var errWrite = errors.New("write failed")
+
+func (errWriter) Write(p []byte) (int, error) { return 0, errWrite }
+
+func TestDecodePNG(t *testing.T) {
+	hash := "LEHV6nWB2yk8pyo0adR*.7kCMdnj"
+	var buf bytes.Buffer
+	if err := DecodePNG(&buf, hash, 37, 23); err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := img.Bounds(); got.Dx() != 37 || got.Dy() != 23 {
+		t.Fatalf("PNG is %dx%d, want 37x23", got.Dx(), got.Dy())
+	}
+	want, err := Decode(hash, 37, 23)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for y := 0; y < 23; y++ {
+		for x := 0; x < 37; x++ {
+			r0, g0, b0, a0 := img.At(x, y).RGBA()
+			r1, g1, b1, a1 := want.At(x, y).RGBA()
+			if r0 != r1 || g0 != g1 || b0 != b1 || a0 != a1 {
+				t.Fatalf("pixel (%d, %d) = %v, want %v", x, y, img.At(x, y), want.At(x, y))
+			}
+		}
+	}
+}
+
+func TestDecodePNGErrors(t *testing.T) {
+	hash := "LEHV6nWB2yk8pyo0adR*.7kCMdnj"
+	var buf bytes.Buffer
+	if err := DecodePNG(&buf, "invalid", 8, 8); !errors.Is(err, ErrInvalidHash) {
+		t.Errorf("invalid hash: error %v, want ErrInvalidHash", err)
+	}
+	if err := DecodePNG(&buf, hash, 0, 8); err == nil {
+		t.Error("zero width succeeded, want error")
+	}
+	if buf.Len() != 0 {
+		t.Errorf("%d bytes written on error", buf.Len())
+	}
+	if err := DecodePNG(errWriter{}, hash, 8, 8); !errors.Is(err, errWrite) {
+		t.Errorf("failing writer: error %v, want %v", err, errWrite)
+	}
+}
@@ -0,0 +1,243 @@
+// Copyright 2021-2022 Nao Yonashiro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blurhash
+
+import (
+	"encoding/hex"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"os"
+	"strings"
+	"testing"
+)
+
+// readPNG decodes the PNG file name in testdata.
+func readPNG(t testing.TB, name string) image.Image {
+	t.Helper()
+	f, err := os.Open("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	img, err := png.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+// referenceImages returns the images of TestReferenceHashes by name.
+// photo.png and gray.png are video-001.png and video-005.gray.png from the
+// image/testdata directory of the Go distribution.
+func referenceImages(t testing.TB) map[string]image.Image {
+	ramp := image.NewGray(image.Rect(0, 0, 64, 16))
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 64; x++ {
+			ramp.SetGray(x, y, color.Gray{Y: uint8(x * 255 / 63)})
+		}
+	}
+	hgrad := image.NewNRGBA(image.Rect(0, 0, 32, 24))
+	for y := 0; y < 24; y++ {
+		for x := 0; x < 32; x++ {
+			v := uint8(x * 255 / 31)
+			hgrad.SetNRGBA(x, y, color.NRGBA{R: v, G: 0x40, B: 255 - v, A: 0xff})
+		}
+	}
+	return map[string]image.Image{
+		"gray ramp":  ramp,
+		"gray photo": readPNG(t, "gray.png"),
+		"red":        solidImage(8, 8, color.NRGBA{R: 0xff, A: 0xff}),
+		"green":      solidImage(8, 8, color.NRGBA{G: 0xff, A: 0xff}),
+		"blue":       solidImage(8, 8, color.NRGBA{B: 0xff, A: 0xff}),
+		"white":      solidImage(8, 8, color.NRGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}),
+		"black":      solidImage(8, 8, color.NRGBA{A: 0xff}),
+		"gradient":   gradientImage(64, 48),
+		"hgradient":  hgrad,
+		"photo":      readPNG(t, "photo.png"),
+	}
+}
+
+// TestReferenceHashes compares Encode with hashes produced by the reference
+// TypeScript implementation (woltapp/blurhash, encode.ts) from the same pixels.
+func TestReferenceHashes(t *testing.T) {
+	images := referenceImages(t)
+	tests := []struct {
+		image string
+		x, y  int
+		want  string
+	}{
+		{"black", 1, 1, "000000"},
+		{"black", 4, 3, "L00000fQfQfQfQfQfQfQfQfQfQfQ"},
+		{"black", 3, 4, "T00000fQfQfQfQfQfQfQfQfQfQfQ"},
+		{"black", 9, 9, "|00000fQfQfQfQfQfQfQfQfQfQfQfQfQfQfQfQfQfQfQfQfQfQfQfQfQfQfQfQfQfQfQfQfQfQfQfQfQfQfQfQfQfQfQfQfQfQfQfQfQfQfQfQfQfQfQfQfQfQfQfQfQfQfQfQfQfQfQfQfQfQfQfQfQfQfQfQfQfQfQfQ"},
+		{"black", 2, 7, "t00000fQfQfQfQfQfQfQfQfQfQfQfQfQ"},
+		{"blue", 1, 1, "000036"},
+		{"blue", 4, 3, "Lf0036fZfQfZfZfTfQfTfQfQfQfQ"},
+		{"blue", 3, 4, "Tf0036fZfQfZfTfQfQfQfQfZfTfQ"},
+		{"blue", 9, 9, "|f0036fZfQfZfQfZfQfZfQfZfTfQfTfQfTfQfTfQfQfQfQfQfQfQfQfQfQfZfTfQfTfQfTfQfTfQfQfQfQfQfQfQfQfQfQfZfTfQfTfQfTfQfTfQfQfQfQfQfQfQfQfQfQfZfTfQfTfQfTfQfTfQfQfQfQfQfQfQfQfQfQ"},
+		{"blue", 2, 7, "tf0036fZfZfTfQfQfZfTfQfQfZfTfQfQ"},
+		{"gradient", 1, 1, "00HB|~"},
+		{"gradient", 4, 3, "LzHB|~2Y$5Sgl|azjtf7gcfjfQfj"},
+		{"gradient", 3, 4, "TzHB|~2Y$5l|azjtgcfjfQnSa|jt"},
+		{"gradient", 9, 9, "|zHB|~2Y$5Sgo1bHa|j[a|l|azjtf7fQf7fQf7fQgcfjfQfjfQfjfQfjfQnSa|jtfQfQfQfQfQfQfjfQfQfQfQfQfQfQfQoLa|jtfQfQfQfQfQfQf7fQfQfQfQfQfQfQfQoea|jtfQfQfQfQfQfQe;fQfQfQfQfQfQfQfQ"},
+		{"gradient", 2, 7, "tzHB|~2Yl|azgcfjnSa|fjfQoLa|f7fQ"},
+		{"gray photo", 1, 1, "00GlL@"},
+		{"gray photo", 4, 3, "LMGlL@~q%May?bof%MM{xuM{M{ay"},
+		{"gray photo", 3, 4, "TMGlL@~q%M?bof%MxuM{M{-;WBM{"},
+		{"gray photo", 9, 9, "|MGlL@~q%May%MIURjRjM{?bof%MM{RjRjofM{RjxuM{M{ayWBRjt7WBay-;WBM{ayRjofWBayj[ayofWBWBM{t7WBRjofRjRjRjoft7ofayj[j[%Mt7WBofxuj[RjfQt7t7M{RjWBWBayRjt7ofayt7ayWBWBWBj[j[ay"},
+		{"gray photo", 2, 7, "tMGlL@~q?bofxuM{-;WBayofRjRj%Mt7"},
+		{"gray ramp", 1, 1, "00HV9w"},
+		{"gray ramp", 4, 3, "L$HV9w00%MRjt7WBj[ayfQfQfQfQ"},
+		{"gray ramp", 3, 4, "T$HV9w00%Mt7WBj[fQfQfQt7WBj["},
+		{"gray ramp", 9, 9, "|$HV9w00%MRjofayayj[ayt7WBj[ayfQfQfQfQfQfQfQfQfQfQfQfQfQfQt7WBj[ayfQfQfQfQfQfQfQfQfQfQfQfQfQfQt7WBj[ayfQfQfQfQfQfQfQfQfQfQfQfQfQfQt7WBj[ayfQfQfQfQfQfQfQfQfQfQfQfQfQfQ"},
+		{"gray ramp", 2, 7, "t$HV9w00t7WBfQfQt7WBfQfQt7WBfQfQ"},
+		{"green", 1, 1, "0009dg"},
+		{"green", 4, 3, "Lf09dghVfQhVhVg0fQg0fQfQfQfQ"},
+		{"green", 3, 4, "Tf09dghVfQhVg0fQfQfQfQhVg0fQ"},
+		{"green", 9, 9, "|f09dghVfQhVfQhVfQhVfQhVg0fQg0fQg0fQg0fQfQfQfQfQfQfQfQfQfQhVg0fQg0fQg0fQg0fQfQfQfQfQfQfQfQfQfQhVg0fQg0fQg0fQg0fQfQfQfQfQfQfQfQfQfQhVg0fQg0fQg0fQg0fQfQfQfQfQfQfQfQfQfQ"},
+		{"green", 2, 7, "tf09dghVhVg0fQfQhVg0fQfQhVg0fQfQ"},
+		{"hgradient", 1, 1, "00HbW}"},
+		{"hgradient", 4, 3, "L.HbW}2gw%W@oMWrjufRfQfQfQfQ"},
+		{"hgradient", 3, 4, "T.HbW}2gw%oMWrjufQfQfQoMWrju"},
+		{"hgradient", 9, 9, "|.HbW}2gw%W@b0oNWsoNWsoMWrjufRfRfRfRfRfRfQfQfQfQfQfQfQfQfQoMWrjufRfRfRfRfRfRfQfQfQfQfQfQfQfQfQoMWrjufRfRfRfRfRfRfQfQfQfQfQfQfQfQfQoMWrjufRfRfRfRfRfRfQfQfQfQfQfQfQfQfQ"},
+		{"hgradient", 2, 7, "t.HbW}2goMWrfQfQoMWrfQfQoMWrfQfQ"},
+		{"photo", 1, 1, "00I|j_"},
+		{"photo", 4, 3, "LdI|j_xtE0RkD4Rj-=t7o~t7MwRj"},
+		{"photo", 3, 4, "TdI|j_xtE0D4Rj-=o~t7MwoyR*bc"},
+		{"photo", 9, 9, "|dI|j_xtE0RkRPV@R+j]aeD4Rj-=t7R*ofIVWAWBo~t7MwRjozoJxuofoKoyR*bckCoJWBofjYkC9aWBS5oKoKs:oJj[oet8s:V?a}t7W;xta|j[r=WVt7R*WVR*RkoeWCWEWBWVs:Rjt6WVazoft7s:aefjt6WXofj[ay"},
+		{"photo", 2, 7, "tdI|j_xtD4Rjo~t7oyR*9aWBt8s:r=WV"},
+		{"red", 1, 1, "00TI:j"},
+		{"red", 4, 3, "LfTI:j|cfQ|c|csUfQsUfQfQfQfQ"},
+		{"red", 3, 4, "TfTI:j|cfQ|csUfQfQfQfQ|csUfQ"},
+		{"red", 9, 9, "|fTI:j|cfQ|cfQ|cfQ|cfQ|csUfQsUfQsUfQsUfQfQfQfQfQfQfQfQfQfQ|csUfQsUfQsUfQsUfQfQfQfQfQfQfQfQfQfQ|csUfQsUfQsUfQsUfQfQfQfQfQfQfQfQfQfQ|csUfQsUfQsUfQsUfQfQfQfQfQfQfQfQfQfQ"},
+		{"red", 2, 7, "tfTI:j|c|csUfQfQ|csUfQfQ|csUfQfQ"},
+		{"white", 1, 1, "00TSUA"},
+		{"white", 4, 3, "LfTSUA~qfQ~q~qt7fQt7fQfQfQfQ"},
+		{"white", 3, 4, "TfTSUA~qfQ~qt7fQfQfQfQ~qt7fQ"},
+		{"white", 9, 9, "|fTSUA~qfQ~qfQ~qfQ~qfQ~qt7fQt7fQt7fQt7fQfQfQfQfQfQfQfQfQfQ~qt7fQt7fQt7fQt7fQfQfQfQfQfQfQfQfQfQ~qt7fQt7fQt7fQt7fQfQfQfQfQfQfQfQfQfQ~qt7fQt7fQt7fQt7fQfQfQfQfQfQfQfQfQfQ"},
+		{"white", 2, 7, "tfTSUA~q~qt7fQfQ~qt7fQfQ~qt7fQfQ"},
+	}
+	for _, tt := range tests {
+		got := Encode(images[tt.image], tt.x, tt.y)
+		if got == tt.want {
+			continue
+		}
+		i := 0
+		for i < len(got) && i < len(tt.want) && got[i] == tt.want[i] {
+			i++
+		}
+		t.Errorf("%s %dx%d: Encode = %q, want %q (first difference at byte %d)", tt.image, tt.x, tt.y, got, tt.want, i)
+	}
+}
+
+// TestReferenceDecode compares Decode with the pixels produced by the reference
+// TypeScript implementation (woltapp/blurhash, decode.ts) at 12x9. Each line of
+// testdata/reference_decode.txt holds a hash and the hex of its R, G, B bytes.
+func TestReferenceDecode(t *testing.T) {
+	const width, height = 12, 9
+	data, err := os.ReadFile("testdata/reference_decode.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		fields := strings.Split(line, "\t")
+		hash := fields[0]
+		want, err := hex.DecodeString(fields[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := Decode(hash, width, height)
+		if err != nil {
+			t.Errorf("Decode(%q): %v", hash, err)
+			continue
+		}
+		for i := 0; i < width*height; i++ {
+			got := img.Pix[i*4 : i*4+3]
+			for c := 0; c < 3; c++ {
+				if d := int(got[c]) - int(want[i*3+c]); d < -1 || d > 1 {
+					t.Errorf("Decode(%q): pixel (%d, %d) = %v, want %v", hash, i%width, i/width, got, want[i*3:i*3+3])
+					break
+				}
+			}
+		}
+	}
+}
+
+// meanAbsError returns the mean absolute difference of the 8-bit color channels
+// of a and b over the bounds of a.
+func meanAbsError(a, b image.Image) float64 {
+	bounds := a.Bounds()
+	var sum float64
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r0, g0, b0, _ := a.At(x, y).RGBA()
+			r1, g1, b1, _ := b.At(x, y).RGBA()
+			sum += math.Abs(float64(r0>>8)-float64(r1>>8)) +
+				math.Abs(float64(g0>>8)-float64(g1>>8)) +
+				math.Abs(float64(b0>>8)-float64(b1>>8))
+		}
+	}
+	return sum / float64(bounds.Dx()*bounds.Dy()*3)
+}
+
+// TestFidelity compares the decoded hash of real images with an area-averaged
+// downscale of the original, which is what a blurhash approximates. The limits
+// are about 1.25 times the measured errors; the photos have much more detail
+// than the components can hold. The decode must also beat a flat image of the
+// average color by a wide margin, which catches encoding the wrong region or
+// clamping colors.
+func TestFidelity(t *testing.T) {
+	images := referenceImages(t)
+	photo := images["photo"].(*image.RGBA)
+	tests := []struct {
+		name   string
+		img    image.Image
+		x, y   int
+		maxErr float64
+	}{
+		{"photo", photo, 4, 3, 57},
+		{"photo", photo, 9, 9, 47},
+		{"photo crop", photo.SubImage(image.Rect(40, 30, 140, 100)), 4, 3, 58},
+		{"photo crop", photo.SubImage(image.Rect(40, 30, 140, 100)), 9, 9, 47},
+		{"gray photo", images["gray photo"], 4, 3, 38},
+		{"gray photo", images["gray photo"], 9, 9, 28},
+		{"gradient", images["gradient"], 4, 3, 12},
+		{"gradient", images["gradient"], 9, 9, 10},
+		{"hgradient", images["hgradient"], 4, 3, 12},
+		{"gray ramp", images["gray ramp"], 4, 3, 14},
+	}
+	for _, tt := range tests {
+		want := Downsample(tt.img, 16, 16)
+		bounds := want.Bounds()
+		hash := Encode(tt.img, tt.x, tt.y)
+		got, err := Decode(hash, bounds.Dx(), bounds.Dy())
+		if err != nil {
+			t.Fatal(err)
+		}
+		avg, err := DecodeAverageColor(hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		e, flat := meanAbsError(got, want), meanAbsError(want, image.NewUniform(avg))
+		if e > tt.maxErr {
+			t.Errorf("%s %dx%d: mean error %.1f, want at most %v", tt.name, tt.x, tt.y, e, tt.maxErr)
+		}
+		if e > 0.75*flat {
+			t.Errorf("%s %dx%d: mean error %.1f, want well below %.1f of the average color", tt.name, tt.x, tt.y, e, flat)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright 2021-2022 Nao Yonashiro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blurhash
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// RowWriter computes a blurhash from pixel rows supplied one at a time, so the
+// whole image never has to be held in memory. Rows use the layout of image.RGBA.Pix,
+// 4 bytes per pixel with the alpha byte ignored. They may be written in any order,
+// but writing them from top to bottom produces exactly the hash Encode would.
+type RowWriter struct {
+	imgW, imgH, w, h int
+
+	xCos, yCos []float64
+	factorsR   [81]float64
+	factorsG   [81]float64
+	factorsB   [81]float64
+
+	written []bool
+	n       int
+	partial []byte
+	next    int
+}
+
+// NewRowWriter returns a RowWriter for an imgW x imgH image encoded with w x h components.
+// It panics if w or h is not in range 1..9, like Append.
+func NewRowWriter(imgW, imgH, w, h int) *RowWriter {
+	if !validComponents(w, h) {
+		panic(ErrInvalidComponents)
+	}
+	if imgW < 0 || imgH < 0 {
+		panic(fmt.Sprintf("blurhash: invalid image size %dx%d", imgW, imgH))
+	}
+	return &RowWriter{
+		imgW:    imgW,
+		imgH:    imgH,
+		w:       w,
+		h:       h,
+		xCos:    cosTable(nil, imgW, w),
+		yCos:    cosTable(nil, imgH, h),
+		written: make([]bool, imgH),
+	}
+}
+
+// WriteRow accumulates row y of the image. pix must hold exactly imgW pixels.
+func (rw *RowWriter) WriteRow(y int, pix []byte) error {
+	if y < 0 || y >= rw.imgH {
+		return fmt.Errorf("blurhash: row %d out of range 0..%d", y, rw.imgH-1)
+	}
+	if len(pix) != rw.imgW*4 {
+		return fmt.Errorf("blurhash: row has %d bytes, want %d", len(pix), rw.imgW*4)
+	}
+	if rw.written[y] {
+		return fmt.Errorf("blurhash: row %d written twice", y)
+	}
+	rw.written[y] = true
+	rw.n++
+
+	w, h := rw.w, rw.h
+	yCos := rw.yCos[y*9 : y*9+h]
+	for x := 0; x < rw.imgW; x++ {
+		p := pix[x*4 : x*4+3 : x*4+3]
+		c := factor{
+			r: sRGB(p[0]).linear(),
+			g: sRGB(p[1]).linear(),
+			b: sRGB(p[2]).linear(),
+		}
+		xCos := rw.xCos[x*9 : x*9+w]
+		if w == 4 && h == 3 {
+			accumulate4x3(&rw.factorsR, &rw.factorsG, &rw.factorsB, xCos, yCos, c)
+			continue
+		}
+		for i := 0; i < h; i++ {
+			for j, xc := range xCos {
+				basis := yCos[i] * xc
+				rw.factorsR[i*w+j] += basis * c.r
+				rw.factorsG[i*w+j] += basis * c.g
+				rw.factorsB[i*w+j] += basis * c.b
+			}
+		}
+	}
+	return nil
+}
+
+// Write implements io.Writer. It treats p as the next bytes of the image in
+// row-major order, and may be mixed with calls to WriteRow for later rows.
+func (rw *RowWriter) Write(p []byte) (int, error) {
+	stride := rw.imgW * 4
+	n := 0
+	for len(p) > 0 {
+		if rw.next >= rw.imgH {
+			return n, errors.New("blurhash: write past the end of the image")
+		}
+		if len(rw.partial) == 0 && len(p) >= stride {
+			if err := rw.WriteRow(rw.next, p[:stride]); err != nil {
+				return n, err
+			}
+			rw.next++
+			p = p[stride:]
+			n += stride
+			continue
+		}
+		k := minInt(stride-len(rw.partial), len(p))
+		rw.partial = append(rw.partial, p[:k]...)
+		p = p[k:]
+		n += k
+		if len(rw.partial) == stride {
+			if err := rw.WriteRow(rw.next, rw.partial); err != nil {
+				return n, err
+			}
+			rw.next++
+			rw.partial = rw.partial[:0]
+		}
+	}
+	return n, nil
+}
+
+// Hash returns the blurhash of the rows written so far.
+// It returns an error unless every row has been written.
+func (rw *RowWriter) Hash() (string, error) {
+	if rw.n != rw.imgH {
+		for y, ok := range rw.written {
+			if !ok {
+				return "", fmt.Errorf("blurhash: row %d not written", y)
+			}
+		}
+	}
+	factors := make([]factor, 81)[:rw.w*rw.h]
+	if rw.imgW > 0 && rw.imgH > 0 {
+		for i := range factors {
+			factors[i] = factor{r: rw.factorsR[i], g: rw.factorsG[i], b: rw.factorsB[i]}
+		}
+		normalizeFactors(factors, float64(rw.imgW*rw.imgH))
+	}
+	dst := make([]byte, 0, EncodedLen(rw.w, rw.h))
+	return string(appendFactors(dst, factors, rw.w, rw.h, newEncodeConfig(nil))), nil
+}
+
+// cosTable stores cos(π·i·x/n) at table[x*9+i] for i < k. It evaluates the basis
+// with the same operations as the reference implementation, so that values are
+// bit-identical to it. It reuses the memory of table if it is large enough.
+func cosTable(table []float64, n, k int) []float64 {
+	if cap(table) < n*9 {
+		table = make([]float64, n*9)
+	}
+	table = table[:n*9]
+	for i := 0; i < k; i++ {
+		for x := 0; x < n; x++ {
+			table[x*9+i] = math.Cos(math.Pi * float64(i) * float64(x) / float64(n))
+		}
+	}
+	return table
+}
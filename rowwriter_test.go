@@ -0,0 +1,83 @@
+// Copyright 2021-2022 Nao Yonashiro
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blurhash
+
+import (
+	"image"
+	"image/draw"
+	"testing"
+)
+
+func TestRowWriter(t *testing.T) {
+	for name, img := range referenceImages(t) {
+		rgba := image.NewRGBA(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
+		draw.Draw(rgba, rgba.Rect, img, img.Bounds().Min, draw.Src)
+		imgW, imgH := rgba.Rect.Dx(), rgba.Rect.Dy()
+		for _, grid := range [][2]int{{1, 1}, {4, 3}, {3, 4}, {9, 9}} {
+			want := Encode(img, grid[0], grid[1])
+
+			rw := NewRowWriter(imgW, imgH, grid[0], grid[1])
+			for y := 0; y < imgH; y++ {
+				if err := rw.WriteRow(y, rgba.Pix[y*rgba.Stride:y*rgba.Stride+imgW*4]); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got, err := rw.Hash(); err != nil || got != want {
+				t.Errorf("%s %dx%d: WriteRow gives %q, %v, want %q", name, grid[0], grid[1], got, err, want)
+			}
+
+			// Write in chunks that do not line up with rows.
+			rw = NewRowWriter(imgW, imgH, grid[0], grid[1])
+			for p := rgba.Pix; len(p) > 0; {
+				n := minInt(len(p), 1000)
+				if _, err := rw.Write(p[:n]); err != nil {
+					t.Fatal(err)
+				}
+				p = p[n:]
+			}
+			if got, err := rw.Hash(); err != nil || got != want {
+				t.Errorf("%s %dx%d: Write gives %q, %v, want %q", name, grid[0], grid[1], got, err, want)
+			}
+		}
+	}
+}
+
+func TestRowWriterMissingRow(t *testing.T) {
+	rw := NewRowWriter(2, 3, 4, 3)
+	row := make([]byte, 2*4)
+	for _, y := range []int{0, 2} {
+		if err := rw.WriteRow(y, row); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := rw.Hash(); err == nil {
+		t.Error("Hash succeeded with row 1 missing")
+	}
+	if err := rw.WriteRow(2, row); err == nil {
+		t.Error("WriteRow accepted row 2 twice")
+	}
+	if err := rw.WriteRow(3, row); err == nil {
+		t.Error("WriteRow accepted row 3 of 3")
+	}
+	if err := rw.WriteRow(1, row[:4]); err == nil {
+		t.Error("WriteRow accepted a short row")
+	}
+	if err := rw.WriteRow(1, row); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rw.Hash(); err != nil {
+		t.Error(err)
+	}
+}